@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// client calls the nodes of a cluster the way they call each other.
+type client struct {
+	timeouts  internal.Timeouts
+	tlsConfig *tls.Config
+}
+
+func newClient(c *internal.ClusterConfig) (*client, error) {
+	cl := &client{timeouts: internal.DefaultTimeouts}
+	if c.Timeouts.Dial > 0 {
+		cl.timeouts.Dial = time.Duration(c.Timeouts.Dial)
+	}
+	if c.Timeouts.RPC > 0 {
+		cl.timeouts.RPC = time.Duration(c.Timeouts.RPC)
+	}
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+		cl.tlsConfig = tlsConfig
+	}
+	return cl, nil
+}
+
+// call calls method on the node at address, waiting for the reply no longer
+// than the RPC timeout.
+func (cl *client) call(address, method string, args, reply any) error {
+	return cl.callWithin(cl.timeouts.RPC, address, method, args, reply)
+}
+
+// submitTimeout bounds the wait for a transaction: the coordinator calls its
+// peers twice, prepare then commit, each call bounded by the dial and RPC
+// timeouts.
+func (cl *client) submitTimeout() time.Duration {
+	return 2*(cl.timeouts.Dial+cl.timeouts.RPC) + cl.timeouts.RPC
+}
+
+// callWithin is call waiting for the reply no longer than timeout, so a
+// stuck node cannot block the command.
+func (cl *client) callWithin(timeout time.Duration, address, method string, args, reply any) error {
+	dialer := &net.Dialer{Timeout: cl.timeouts.Dial}
+
+	var conn net.Conn
+	var err error
+	if cl.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, cl.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	rpcClient := rpc.NewClient(conn)
+	defer rpcClient.Close()
+
+	return rpcClient.Call(method, args, reply)
+}
+
+const txUsage = `Usage: 2pc tx [flags] <operation>
+
+Operations on the default Counter state machine:
+  add N       add N to the register
+  set N       set the register to N
+  cas E N     set the register to N if it holds E
+  raw HEX     submit an arbitrary state machine command
+
+Flags:`
+
+func runTx(args []string) error {
+	fs := flag.NewFlagSet("tx", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), txUsage)
+		fs.PrintDefaults()
+	}
+	var cf clusterFlags
+	cf.register(fs)
+	nodeID := fs.Int("node", 0, "ID of the node coordinating the transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cmd, err := parseOperation(fs.Args())
+	if err != nil {
+		fs.Usage()
+		return err
+	}
+
+	c, err := cf.load()
+	if err != nil {
+		return err
+	}
+	node, ok := c.Node(*nodeID)
+	if !ok {
+		return fmt.Errorf("node %d is not part of the cluster", *nodeID)
+	}
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+
+	var reply internal.SubmitReply
+	if err := cl.callWithin(cl.submitTimeout(), node.Address, "Node.Submit", internal.SubmitArgs{Command: cmd}, &reply); err != nil {
+		return err
+	}
+
+	fmt.Printf("txID:    %s\n", reply.TxID)
+	if reply.Committed {
+		fmt.Println("outcome: committed")
+		return nil
+	}
+
+	fmt.Println("outcome: aborted")
+	if reply.Reason != nil {
+		fmt.Printf("reason:  node %d voted no (%s): %s\n", reply.Reason.NodeID, reply.Reason.Code, reply.Reason.Message)
+	} else {
+		fmt.Printf("reason:  %s\n", reply.Error)
+	}
+	return errors.New("transaction aborted")
+}
+
+// parseOperation builds the state machine command of an operation given on
+// the command line.
+func parseOperation(args []string) ([]byte, error) {
+	if len(args) == 0 {
+		return nil, errors.New("missing operation")
+	}
+
+	ints := func(want int) ([]int, error) {
+		if len(args) != want+1 {
+			return nil, fmt.Errorf("%s takes %d argument(s)", args[0], want)
+		}
+		values := make([]int, want)
+		for i, s := range args[1:] {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s argument %q", args[0], s)
+			}
+			values[i] = v
+		}
+		return values, nil
+	}
+
+	switch args[0] {
+	case "add":
+		v, err := ints(1)
+		if err != nil {
+			return nil, err
+		}
+		return store.CounterAdd(v[0]), nil
+	case "set":
+		v, err := ints(1)
+		if err != nil {
+			return nil, err
+		}
+		return store.CounterSet(v[0]), nil
+	case "cas":
+		v, err := ints(2)
+		if err != nil {
+			return nil, err
+		}
+		return store.CounterCompareAndSet(v[0], v[1]), nil
+	case "raw":
+		if len(args) != 2 {
+			return nil, errors.New("raw takes 1 argument")
+		}
+		return hex.DecodeString(args[1])
+	}
+	return nil, fmt.Errorf("unknown operation %q", args[0])
+}
+
+func runStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: 2pc status [flags] <txID>")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "A node that voted yes and awaits the outcome reports PREPARED. Nodes use presumed abort:")
+		fmt.Fprintln(fs.Output(), "a transaction a node neither committed nor prepared is reported ABORTED.")
+		fmt.Fprintln(fs.Output())
+		fmt.Fprintln(fs.Output(), "Flags:")
+		fs.PrintDefaults()
+	}
+	var cf clusterFlags
+	cf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("expected a single txID")
+	}
+	txID, err := uuid.Parse(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("invalid txID: %w", err)
+	}
+
+	c, err := cf.load()
+	if err != nil {
+		return err
+	}
+	cl, err := newClient(c)
+	if err != nil {
+		return err
+	}
+	nodes := c.Addresses()
+	ids := c.IDs()
+
+	// Every node is asked concurrently so an unreachable one only costs a
+	// single dial timeout.
+	views := make([]string, len(ids))
+	done := make(chan struct{})
+	for i, id := range ids {
+		go func() {
+			defer func() { done <- struct{}{} }()
+
+			var state store.TransactionState
+			if err := cl.call(nodes[id], "Node.GetStatus", txID, &state); err != nil {
+				views[i] = "error: " + err.Error()
+				return
+			}
+			views[i] = state.String()
+		}()
+	}
+	for range ids {
+		<-done
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tADDRESS\tSTATE")
+	for i, id := range ids {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", id, nodes[id], views[i])
+	}
+	return tw.Flush()
+}
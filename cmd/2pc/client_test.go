@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+)
+
+func TestClient_CallGivesUpOnAStuckNode(t *testing.T) {
+	// The node accepts the connection but never answers.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cl, err := newClient(&internal.ClusterConfig{Timeouts: internal.TimeoutsConfig{RPC: internal.Duration(100 * time.Millisecond)}})
+	if err != nil {
+		t.Fatalf("newClient failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var index internal.CommitIndex
+		done <- cl.call(l.Addr().String(), "Node.GetCommitIndex", 0, &index)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Expected the call to a stuck node to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call to a stuck node did not time out")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+)
+
+// stopTimeout is how long a node stopped gracefully may take before it is
+// killed.
+const stopTimeout = 5 * time.Second
+
+const clusterUsage = `Usage: 2pc cluster up [flags]
+
+Starts every node of the cluster as its own process and prefixes their logs
+with the node ID. Once up, it reads commands on stdin:
+
+  kill N      kill node N with SIGKILL, as in a crash
+  stop N      stop node N gracefully
+  start N     start node N again
+  restart N   kill node N and start it again
+  ps          list the nodes and whether they run
+  quit        stop every node and exit (also on EOF or Ctrl-C)
+
+Flags:`
+
+func runCluster(args []string) error {
+	if len(args) < 1 || args[0] != "up" {
+		fmt.Fprintln(os.Stderr, clusterUsage)
+		if len(args) < 1 {
+			return errors.New("missing subcommand")
+		}
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+
+	fs := flag.NewFlagSet("cluster up", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), clusterUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "", "cluster config file (.yaml, .yml or .json)")
+	size := fs.Int("size", 0, "without --config, run this many nodes on localhost:3000+ID")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	var c *internal.ClusterConfig
+	var clusterArgs []string
+	switch {
+	case *configPath != "":
+		loaded, err := internal.LoadClusterConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		// Nodes may not run from the launcher's directory.
+		path, err := filepath.Abs(*configPath)
+		if err != nil {
+			return err
+		}
+		c, clusterArgs = loaded, []string{"--config", path}
+	case *size > 0:
+		c = &internal.ClusterConfig{}
+		peers := make([]string, 0, *size)
+		for id := range *size {
+			address := "localhost:" + strconv.Itoa(3000+id)
+			c.Nodes = append(c.Nodes, internal.NodeConfig{ID: id, Address: address})
+			peers = append(peers, fmt.Sprintf("%d=%s", id, address))
+		}
+		clusterArgs = []string{"--peers", strings.Join(peers, ",")}
+	default:
+		fs.Usage()
+		return errors.New("set --config or --size")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	l := &launcher{
+		exe:         exe,
+		clusterArgs: clusterArgs,
+		ids:         c.IDs(),
+		procs:       make(map[int]*process),
+		out:         os.Stdout,
+	}
+	for _, id := range l.ids {
+		l.prefixWidth = max(l.prefixWidth, len(strconv.Itoa(id)))
+	}
+
+	for _, id := range l.ids {
+		if err := l.start(id); err != nil {
+			l.stopAll()
+			return err
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	commands := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- scanner.Text()
+		}
+		close(commands)
+	}()
+
+	for {
+		select {
+		case <-signals:
+			l.stopAll()
+			return nil
+		case line, ok := <-commands:
+			if !ok {
+				l.stopAll()
+				return nil
+			}
+			if quit := l.handle(line); quit {
+				l.stopAll()
+				return nil
+			}
+		}
+	}
+}
+
+// launcher runs the nodes of a cluster as child processes.
+type launcher struct {
+	exe         string
+	clusterArgs []string
+	ids         []int
+	prefixWidth int
+
+	mu    sync.Mutex
+	procs map[int]*process
+
+	outMu sync.Mutex
+	out   io.Writer
+}
+
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+func (l *launcher) logf(id int, format string, args ...any) {
+	l.writeLine(id, "-- "+fmt.Sprintf(format, args...))
+}
+
+func (l *launcher) writeLine(id int, line string) {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	fmt.Fprintf(l.out, "node %-*d | %s\n", l.prefixWidth, id, line)
+}
+
+// pipe copies the lines of r to the output, prefixed with the node ID.
+func (l *launcher) pipe(id int, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		l.writeLine(id, scanner.Text())
+	}
+}
+
+func (l *launcher) start(id int) error {
+	if !slices.Contains(l.ids, id) {
+		return fmt.Errorf("node %d is not part of the cluster", id)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if p, ok := l.procs[id]; ok && !p.exited() {
+		return fmt.Errorf("node %d is already running", id)
+	}
+
+	args := append([]string{"node", "--id", strconv.Itoa(id)}, l.clusterArgs...)
+	cmd := exec.Command(l.exe, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	l.procs[id] = p
+	l.logf(id, "started (pid %d)", cmd.Process.Pid)
+
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go l.pipe(id, stdout, &pipes)
+	go l.pipe(id, stderr, &pipes)
+	go func() {
+		// The pipes must be drained before Wait closes them.
+		pipes.Wait()
+		err := cmd.Wait()
+		if err != nil {
+			l.logf(id, "exited: %v", err)
+		} else {
+			l.logf(id, "exited")
+		}
+		close(p.done)
+	}()
+
+	return nil
+}
+
+func (p *process) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *launcher) running(id int) (*process, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.procs[id]
+	if !ok || p.exited() {
+		return nil, fmt.Errorf("node %d is not running", id)
+	}
+	return p, nil
+}
+
+// kill stops node id at once, the way a crash would.
+func (l *launcher) kill(id int) error {
+	p, err := l.running(id)
+	if err != nil {
+		return err
+	}
+	if err := p.cmd.Process.Kill(); err != nil {
+		return err
+	}
+	<-p.done
+	return nil
+}
+
+// stop lets node id shut down, and kills it if it takes too long.
+func (l *launcher) stop(id int) error {
+	p, err := l.running(id)
+	if err != nil {
+		return err
+	}
+	if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+		return err
+	}
+
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		l.logf(id, "did not stop within %v, killing it", stopTimeout)
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	return nil
+}
+
+func (l *launcher) stopAll() {
+	var wg sync.WaitGroup
+	for _, id := range l.ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.stop(id)
+		}()
+	}
+	wg.Wait()
+}
+
+// handle runs a command read on stdin and reports whether to quit.
+func (l *launcher) handle(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch fields[0] {
+	case "quit", "exit":
+		return true
+	case "ps":
+		l.mu.Lock()
+		for _, id := range l.ids {
+			state := "stopped"
+			if p, ok := l.procs[id]; ok && !p.exited() {
+				state = fmt.Sprintf("running (pid %d)", p.cmd.Process.Pid)
+			}
+			l.logf(id, "%s", state)
+		}
+		l.mu.Unlock()
+		return false
+	}
+
+	actions := map[string]func(int) error{
+		"kill":  l.kill,
+		"stop":  l.stop,
+		"start": l.start,
+		"restart": func(id int) error {
+			if err := l.kill(id); err != nil {
+				return err
+			}
+			return l.start(id)
+		},
+	}
+	action, ok := actions[fields[0]]
+	if !ok || len(fields) != 2 {
+		fmt.Fprintln(os.Stderr, "commands: kill N, stop N, start N, restart N, ps, quit")
+		return false
+	}
+
+	id, err := strconv.Atoi(fields[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid node ID %q\n", fields[1])
+		return false
+	}
+	if err := action(id); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return false
+}
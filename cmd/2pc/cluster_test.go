@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// runMainEnv makes the test binary run as the 2pc command, so the launcher
+// can start it as a node.
+const runMainEnv = "TWOPC_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// freeAddress returns a local address nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestClusterUp_RestartsANodeAndStopsEveryNode(t *testing.T) {
+	t.Setenv(runMainEnv, "1")
+
+	dir := t.TempDir()
+	config := fmt.Sprintf("data_dir: %s\nnodes:\n", filepath.Join(dir, "data"))
+	for id := range 3 {
+		config += fmt.Sprintf("  - id: %d\n    address: %s\n", id, freeAddress(t))
+	}
+	path := filepath.Join(dir, "cluster.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	c, err := internal.LoadClusterConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	cl, err := newClient(c)
+	if err != nil {
+		t.Fatalf("newClient failed: %v", err)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Executable failed: %v", err)
+	}
+	var out bytes.Buffer
+	l := &launcher{
+		exe:         exe,
+		clusterArgs: []string{"--config", path},
+		ids:         c.IDs(),
+		procs:       make(map[int]*process),
+		out:         &out,
+		prefixWidth: 1,
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			l.stopAll()
+		}
+		if t.Failed() {
+			t.Logf("Cluster output:\n%s", out.String())
+		}
+	}()
+
+	// waitFor waits until node id answers with its commit index.
+	waitFor := func(id int) internal.CommitIndex {
+		t.Helper()
+		node, _ := c.Node(id)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var index internal.CommitIndex
+			err := cl.call(node.Address, "Node.GetCommitIndex", 0, &index)
+			if err == nil {
+				return index
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Node %d did not come up: %v", id, err)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	submit := func(id int, cmd []byte) {
+		t.Helper()
+		node, _ := c.Node(id)
+		var reply internal.SubmitReply
+		if err := cl.callWithin(cl.submitTimeout(), node.Address, "Node.Submit", internal.SubmitArgs{Command: cmd}, &reply); err != nil {
+			t.Fatalf("Submit to node %d failed: %v", id, err)
+		}
+		if !reply.Committed {
+			t.Fatalf("Transaction %s aborted: %s", reply.TxID, reply.Error)
+		}
+	}
+
+	for _, id := range l.ids {
+		if err := l.start(id); err != nil {
+			t.Fatalf("Failed to start node %d: %v", id, err)
+		}
+	}
+	for _, id := range l.ids {
+		waitFor(id)
+	}
+	submit(0, store.CounterAdd(5))
+
+	// The restarted node comes back with the transaction it committed.
+	l.handle("restart 1")
+	if index := waitFor(1); index.Seq != 1 {
+		t.Errorf("Expected the restarted node at seq 1, got %+v", index)
+	}
+	submit(1, store.CounterAdd(2))
+
+	l.stopAll()
+	stopped = true
+	for _, id := range l.ids {
+		p := l.procs[id]
+		if !p.exited() || !p.cmd.ProcessState.Success() {
+			t.Errorf("Expected node %d to stop cleanly, got %v", id, p.cmd.ProcessState)
+		}
+	}
+}
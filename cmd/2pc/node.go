@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+)
+
+// parsePeers parses a peer list such as "0=host0:3000,1=host1:3001".
+// Duplicates are left for ClusterConfig.Validate to report.
+func parsePeers(s string) ([]internal.NodeConfig, error) {
+	var nodes []internal.NodeConfig
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		id, address, ok := strings.Cut(item, "=")
+		if !ok || address == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected ID=ADDRESS", item)
+		}
+		nodeID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q", id)
+		}
+		nodes = append(nodes, internal.NodeConfig{ID: nodeID, Address: address})
+	}
+	return nodes, nil
+}
+
+// clusterFlags are the flags describing the cluster a command works with:
+// a cluster config file, or a peer list for a cluster without one.
+type clusterFlags struct {
+	configPath string
+	peers      string
+}
+
+func (f *clusterFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.configPath, "config", "", "cluster config file (.yaml, .yml or .json)")
+	fs.StringVar(&f.peers, "peers", "", "nodes of the cluster as ID=ADDRESS,..., without --config")
+}
+
+func (f *clusterFlags) load() (*internal.ClusterConfig, error) {
+	if f.configPath != "" && f.peers != "" {
+		return nil, fmt.Errorf("--config and --peers are exclusive")
+	}
+	if f.configPath != "" {
+		return internal.LoadClusterConfig(f.configPath)
+	}
+	if f.peers == "" {
+		return nil, fmt.Errorf("no cluster given: set --config or --peers")
+	}
+
+	nodes, err := parsePeers(f.peers)
+	if err != nil {
+		return nil, err
+	}
+	c := &internal.ClusterConfig{Nodes: nodes}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func runNode(args []string) error {
+	fs := flag.NewFlagSet("node", flag.ContinueOnError)
+	var cf clusterFlags
+	cf.register(fs)
+	id := fs.Int("id", 0, "ID of the node")
+	listen := fs.String("listen", "", "address to accept RPCs on, overriding the config")
+	admin := fs.String("admin", "", "address of the HTTP admin endpoint, overriding the config")
+	dataDir := fs.String("data-dir", "", "directory of the WAL and snapshots, overriding the config")
+	keyFile := fs.String("key-file", "", "key file to encrypt the WAL and snapshots with, created if missing")
+	trace := fs.String("trace", "", "export spans to \"stdout\" or \"otlp\", overriding the config")
+	otlpEndpoint := fs.String("otlp-endpoint", "", "OTLP/HTTP traces URL, with --trace otlp (default "+internal.DefaultOTLPEndpoint+")")
+	snapshotRecords := fs.Int("snapshot-records", 0, "snapshot once the WAL grew by this many records, 0 to disable, overriding the config")
+	snapshotBytes := fs.Int64("snapshot-bytes", 0, "snapshot once the WAL holds this many bytes, 0 to disable, overriding the config")
+	snapshotInterval := fs.Duration("snapshot-interval", 0, "snapshot at least this often, 0 to disable, overriding the config")
+	antiEntropy := fs.Duration("anti-entropy", 0, "compare the node with its peers this often, 0 to disable, overriding the config")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// Zero values disable what they set, so only flags given count.
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	c, err := cf.load()
+	if err != nil {
+		return err
+	}
+
+	// Flags override the node's entry of the config.
+	i := slices.IndexFunc(c.Nodes, func(n internal.NodeConfig) bool { return n.ID == *id })
+	if i < 0 {
+		return fmt.Errorf("node %d is not part of the cluster", *id)
+	}
+	if *listen != "" {
+		c.Nodes[i].Listen = *listen
+	}
+	if *admin != "" {
+		c.Nodes[i].Admin = *admin
+	}
+	if *dataDir != "" {
+		c.Nodes[i].DataDir = *dataDir
+	}
+	if *keyFile != "" {
+		c.Nodes[i].KeyFile = *keyFile
+	}
+	if *trace != "" {
+		c.Tracing = &internal.TracingConfig{Exporter: *trace, Endpoint: *otlpEndpoint}
+	}
+	if set["snapshot-records"] || set["snapshot-bytes"] || set["snapshot-interval"] {
+		if c.Snapshots == nil {
+			c.Snapshots = internal.NewSnapshotsConfig(internal.DefaultSnapshotPolicy)
+		}
+		if set["snapshot-records"] {
+			c.Snapshots.Records = *snapshotRecords
+		}
+		if set["snapshot-bytes"] {
+			c.Snapshots.Bytes = *snapshotBytes
+		}
+		if set["snapshot-interval"] {
+			c.Snapshots.Interval = internal.Duration(*snapshotInterval)
+		}
+	}
+	if set["anti-entropy"] {
+		c.AntiEntropy = (*internal.Duration)(antiEntropy)
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	opts, err := c.Options(*id)
+	if err != nil {
+		return err
+	}
+	n, err := internal.NewNode(*id, c.Addresses(), opts...)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if err := n.Close(); err != nil {
+		return fmt.Errorf("closing node: %w", err)
+	}
+	return nil
+}
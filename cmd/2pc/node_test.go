@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+)
+
+func TestClusterFlags_LoadsAndValidatesBothConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	loadConfig := func(path string) (*internal.ClusterConfig, error) {
+		f := clusterFlags{configPath: path}
+		return f.load()
+	}
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	yamlConfig, err := loadConfig(write("cluster.yaml", `
+protocol: 2pc
+data_dir: /var/lib/2pc
+timeouts:
+  dial: 500ms
+  rpc: 3s
+nodes:
+  - id: 0
+    address: node0:3000
+  - id: 1
+    address: node1:3001
+    listen: ":3001"
+    data_dir: /data/node1
+`))
+	if err != nil {
+		t.Fatalf("Failed to load YAML config: %v", err)
+	}
+	jsonConfig, err := loadConfig(write("cluster.json", `{
+  "protocol": "2pc",
+  "data_dir": "/var/lib/2pc",
+  "timeouts": {"dial": "500ms", "rpc": "3s"},
+  "nodes": [
+    {"id": 0, "address": "node0:3000"},
+    {"id": 1, "address": "node1:3001", "listen": ":3001", "data_dir": "/data/node1"}
+  ]
+}`))
+	if err != nil {
+		t.Fatalf("Failed to load JSON config: %v", err)
+	}
+	if !reflect.DeepEqual(yamlConfig, jsonConfig) {
+		t.Errorf("YAML and JSON configs differ:\n%+v\n%+v", yamlConfig, jsonConfig)
+	}
+	if jsonConfig.Timeouts.RPC != internal.Duration(3*time.Second) {
+		t.Errorf("Expected an RPC timeout of 3s, got %v", time.Duration(jsonConfig.Timeouts.RPC))
+	}
+	if addresses := jsonConfig.Addresses(); addresses[1] != "node1:3001" || len(addresses) != 2 {
+		t.Errorf("Unexpected addresses %v", addresses)
+	}
+
+	// Every problem is reported at once.
+	_, err = loadConfig(write("invalid.yaml", `
+protocol: 3pc
+tls:
+  cert_file: node.crt
+nodes:
+  - id: 0
+    address: node0:3000
+  - id: 0
+    address: node1:3001
+  - id: 2
+    address: node0:3000
+`))
+	if !errors.Is(err, internal.ErrInvalidConfig) {
+		t.Fatalf("Expected ErrInvalidConfig, got %v", err)
+	}
+	for _, problem := range []string{"protocol", "key_file", "node 0 is listed twice", "nodes 0 and 2 share the address node0:3000"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q to be reported, got: %v", problem, err)
+		}
+	}
+
+	if _, err := loadConfig(write("typo.json", `{"nodes": [{"id": 0, "adress": "node0:3000"}]}`)); !errors.Is(err, internal.ErrInvalidConfig) {
+		t.Errorf("Expected an unknown field to be rejected, got %v", err)
+	}
+	if _, err := loadConfig(write("cluster.toml", `nodes = []`)); err == nil {
+		t.Error("Expected an unsupported format to be rejected")
+	}
+
+	// Background snapshots and anti-entropy are tuned, or turned off, in
+	// the config.
+	tuned, err := loadConfig(write("tuned.yaml", `
+snapshots:
+  records: 500
+  interval: 1m
+anti_entropy: 0s
+nodes:
+  - id: 0
+    address: node0:3000
+`))
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if policy := tuned.Snapshots.Policy(); policy != (internal.SnapshotPolicy{Records: 500, Interval: time.Minute}) {
+		t.Errorf("Unexpected snapshot policy %+v", policy)
+	}
+	if tuned.AntiEntropy == nil || *tuned.AntiEntropy != 0 {
+		t.Errorf("Expected anti-entropy turned off, got %v", tuned.AntiEntropy)
+	}
+	if yamlConfig.Snapshots != nil || yamlConfig.AntiEntropy != nil {
+		t.Errorf("Expected the defaults without snapshots and anti_entropy, got %+v", yamlConfig)
+	}
+	if _, err := loadConfig(write("negative.yaml", "snapshots:\n  records: -1\nnodes:\n  - id: 0\n    address: node0:3000\n")); !errors.Is(err, internal.ErrInvalidConfig) {
+		t.Errorf("Expected a negative threshold to be rejected, got %v", err)
+	}
+
+	// Without a config file, the peer list is validated the same way.
+	f := clusterFlags{peers: "0=node0:3000,0=node1:3001"}
+	if _, err := f.load(); !errors.Is(err, internal.ErrInvalidConfig) {
+		t.Errorf("Expected duplicate peers to be rejected, got %v", err)
+	}
+	f = clusterFlags{configPath: filepath.Join(dir, "cluster.json"), peers: "0=node0:3000"}
+	if _, err := f.load(); err == nil {
+		t.Error("Expected --config and --peers to be exclusive")
+	}
+}
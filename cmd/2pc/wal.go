@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+const walUsage = `Usage: 2pc wal <subcommand> [flags]
+
+Subcommands:
+  dump      print the records of the WAL
+  verify    check that the WAL and the snapshot can be read back
+  truncate  cut the WAL at an offset, dropping a corrupted tail
+
+The node must not be running for truncate.`
+
+func runWAL(args []string) error {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, walUsage)
+		return errors.New("missing subcommand")
+	}
+
+	switch args[0] {
+	case "dump":
+		return walDump(args[1:])
+	case "verify":
+		return walVerify(args[1:])
+	case "truncate":
+		return walTruncate(args[1:])
+	}
+
+	fmt.Fprintln(os.Stderr, walUsage)
+	return fmt.Errorf("unknown subcommand %q", args[0])
+}
+
+// walFlags are the flags locating the WAL of a node.
+type walFlags struct {
+	dataDir string
+	nodeID  int
+	keyFile string
+}
+
+func (f *walFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dataDir, "data-dir", internal.DefaultDataDir, "data directory of the node")
+	fs.IntVar(&f.nodeID, "node", 0, "ID of the node")
+	fs.StringVar(&f.keyFile, "key-file", "", "key file of an encrypted WAL")
+}
+
+func (f *walFlags) storeOptions() ([]store.StoreOption, error) {
+	if f.keyFile == "" {
+		return nil, nil
+	}
+
+	// NewFileKeyProvider creates missing key files, which would only hide
+	// a typo here.
+	if _, err := os.Stat(f.keyFile); err != nil {
+		return nil, err
+	}
+	keys, err := store.NewFileKeyProvider(f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []store.StoreOption{store.WithEncryption(keys)}, nil
+}
+
+// withKeyHint tells how to read what err failed to open for lack of a key.
+func withKeyHint(err error) error {
+	switch {
+	case errors.Is(err, store.ErrEncrypted):
+		return fmt.Errorf("%w, pass the node's key file with --key-file", err)
+	case errors.Is(err, store.ErrUnknownKey):
+		return fmt.Errorf("%w, --key-file lacks the key it was sealed with", err)
+	}
+	return err
+}
+
+// walRecord is a WAL record as dump prints it.
+type walRecord struct {
+	Offset    int64     `json:"offset"`
+	LSN       uint64    `json:"lsn"`
+	TxID      uuid.UUID `json:"tx_id"`
+	State     string    `json:"state"`
+	Value     string    `json:"value,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
+	SenderID  int       `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	Version   uint8     `json:"version"`
+}
+
+func newWALRecord(r store.WALRecord) walRecord {
+	return walRecord{
+		Offset:    r.Offset,
+		LSN:       r.Entry.LSN,
+		TxID:      r.Entry.TxID,
+		State:     r.Entry.State.String(),
+		Value:     formatCommand(r.Entry.Command),
+		Seq:       r.Entry.Seq,
+		SenderID:  r.Entry.SenderID,
+		Timestamp: r.Entry.Timestamp,
+		Version:   r.Entry.Version,
+	}
+}
+
+// formatCommand shows a Counter command as the operation it performs, and
+// any other command as hex.
+func formatCommand(cmd []byte) string {
+	if len(cmd) == 0 {
+		return ""
+	}
+
+	op, err := store.DecodeCounterCommand(cmd)
+	if err != nil {
+		return hex.EncodeToString(cmd)
+	}
+	switch op.Op {
+	case store.COUNTER_ADD:
+		return fmt.Sprintf("add %d", op.Value)
+	case store.COUNTER_SET:
+		return fmt.Sprintf("set %d", op.Value)
+	case store.COUNTER_COMPARE_AND_SET:
+		return fmt.Sprintf("cas %d->%d", op.Expected, op.Value)
+	}
+	return hex.EncodeToString(cmd)
+}
+
+func walDump(args []string) error {
+	fs := flag.NewFlagSet("wal dump", flag.ContinueOnError)
+	var wf walFlags
+	wf.register(fs)
+	asJSON := fs.Bool("json", false, "print one JSON object per record")
+	txFilter := fs.String("tx", "", "only print the records of this transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var txID uuid.UUID
+	if *txFilter != "" {
+		id, err := uuid.Parse(*txFilter)
+		if err != nil {
+			return fmt.Errorf("invalid --tx: %w", err)
+		}
+		txID = id
+	}
+
+	opts, err := wf.storeOptions()
+	if err != nil {
+		return err
+	}
+	records, scanErr := store.ScanWAL(wf.dataDir, wf.nodeID, opts...)
+
+	var filtered []walRecord
+	for _, r := range records {
+		if *txFilter != "" && r.Entry.TxID != txID {
+			continue
+		}
+		filtered = append(filtered, newWALRecord(r))
+	}
+
+	if *asJSON {
+		err = dumpJSON(os.Stdout, filtered)
+	} else {
+		err = dumpText(os.Stdout, filtered)
+	}
+	if err != nil {
+		return err
+	}
+
+	return withKeyHint(scanErr)
+}
+
+func dumpJSON(w io.Writer, records []walRecord) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dumpText(w io.Writer, records []walRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OFFSET\tLSN\tTXID\tSTATE\tVALUE\tSEQ\tSENDER")
+	for _, r := range records {
+		seq := ""
+		if r.Seq != 0 {
+			seq = fmt.Sprint(r.Seq)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\t%s\t%d\n",
+			r.Offset, r.LSN, r.TxID, r.State, r.Value, seq, r.SenderID)
+	}
+	return tw.Flush()
+}
+
+func walVerify(args []string) error {
+	fs := flag.NewFlagSet("wal verify", flag.ContinueOnError)
+	var wf walFlags
+	wf.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts, err := wf.storeOptions()
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+
+	snapshot, err := store.LoadSnapshotFile(wf.dataDir, wf.nodeID, opts...)
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Errorf("snapshot: %w", withKeyHint(err)))
+	case snapshot == nil:
+		fmt.Println("snapshot: none")
+	default:
+		fmt.Printf("snapshot: ok (lsn %d, seq %d, watermark %d)\n", snapshot.LSN, snapshot.Seq, snapshot.Watermark)
+	}
+
+	records, err := store.ScanWAL(wf.dataDir, wf.nodeID, opts...)
+	if err != nil {
+		var corruption *store.WALCorruption
+		if errors.As(err, &corruption) {
+			problems = append(problems, fmt.Errorf("wal: %w (truncate with --offset %d)", err, corruption.Offset))
+		} else {
+			problems = append(problems, fmt.Errorf("wal: %w", withKeyHint(err)))
+		}
+	}
+
+	var lastLSN uint64
+	for _, r := range records {
+		e := r.Entry
+		if e.Version > store.PROTOCOL_VERSION {
+			problems = append(problems, fmt.Errorf("wal: record at offset %d has protocol version %d, newer than %d", r.Offset, e.Version, store.PROTOCOL_VERSION))
+		}
+		// Records written before LSNs were introduced carry none.
+		if e.LSN != 0 {
+			if e.LSN <= lastLSN {
+				problems = append(problems, fmt.Errorf("wal: record at offset %d has LSN %d, not above %d", r.Offset, e.LSN, lastLSN))
+			}
+			lastLSN = e.LSN
+		}
+		if e.State < store.TRANSACTION_PREPARED || e.State > store.TRANSACTION_ABORTED {
+			problems = append(problems, fmt.Errorf("wal: record at offset %d has unknown state %d", r.Offset, e.State))
+		}
+	}
+	fmt.Printf("wal: %d records read\n", len(records))
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problem(s)", len(problems))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func walTruncate(args []string) error {
+	fs := flag.NewFlagSet("wal truncate", flag.ContinueOnError)
+	var wf walFlags
+	wf.register(fs)
+	offset := fs.Int64("offset", -1, "byte offset to cut the WAL at, as reported by verify")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *offset < 0 {
+		return errors.New("--offset is required")
+	}
+
+	if err := store.TruncateWAL(wf.dataDir, wf.nodeID, *offset); err != nil {
+		return err
+	}
+
+	fmt.Printf("truncated %s at offset %d\n", store.WALPath(wf.dataDir, wf.nodeID), *offset)
+	return nil
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// NodeStatus is a point-in-time view of a node, served as JSON by the admin
+// endpoint.
+type NodeStatus struct {
+	NodeID  int    `json:"node_id"`
+	Address string `json:"address"`
+	// Ready reports whether the node recovered and caught up with its peers.
+	Ready bool `json:"ready"`
+	// State is the state machine snapshot, and Counter its value when the
+	// state machine is the default Counter.
+	State       []byte      `json:"state"`
+	Counter     *int        `json:"counter,omitempty"`
+	CommitIndex CommitIndex `json:"commit_index"`
+	// LockHolders are the transactions holding the lock.
+	LockHolders []uuid.UUID `json:"lock_holders"`
+	// InDoubt are the transactions the node voted yes for and has not
+	// learned the outcome of yet.
+	InDoubt  []InDoubtTransaction `json:"in_doubt"`
+	Peers    []PeerStatus         `json:"peers"`
+	WAL      store.LogStats       `json:"wal"`
+	Snapshot SnapshotInfo         `json:"snapshot"`
+}
+
+type InDoubtTransaction struct {
+	TxID         uuid.UUID `json:"tx_id"`
+	Coordinator  int       `json:"coordinator"`
+	Participants []int     `json:"participants"`
+	PreparedAt   time.Time `json:"prepared_at"`
+}
+
+func (n *node) Status() (NodeStatus, error) {
+	state, err := n.volatileStore.Snapshot()
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	stats, err := n.stableStore.Stats()
+	if err != nil {
+		return NodeStatus{}, err
+	}
+
+	status := NodeStatus{
+		NodeID:      n.id,
+		Address:     n.address,
+		Ready:       n.ready.Load(),
+		State:       state,
+		CommitIndex: n.CommitIndex(),
+		LockHolders: n.volatileStore.LockHolders(),
+		InDoubt:     []InDoubtTransaction{},
+		Peers:       make([]PeerStatus, 0, len(n.peers)),
+		WAL:         stats,
+		Snapshot:    n.LastSnapshot(),
+	}
+	if counter, ok := n.stateMachine.(*store.Counter); ok {
+		value := counter.Value()
+		status.Counter = &value
+	}
+
+	for _, e := range n.pendingTransactions() {
+		status.InDoubt = append(status.InDoubt, InDoubtTransaction{
+			TxID:         e.TxID,
+			Coordinator:  e.SenderID,
+			Participants: e.Participants,
+			PreparedAt:   e.Timestamp,
+		})
+	}
+	slices.SortFunc(status.InDoubt, func(a, b InDoubtTransaction) int {
+		return a.PreparedAt.Compare(b.PreparedAt)
+	})
+
+	for _, p := range n.peers {
+		status.Peers = append(status.Peers, p.Status())
+	}
+	slices.SortFunc(status.Peers, func(a, b PeerStatus) int { return a.ID - b.ID })
+
+	return status, nil
+}
+
+// serveAdmin starts the admin endpoint on addr:
+//
+//	GET /status   the NodeStatus of the node
+//	GET /metrics  the metrics of the node, in the Prometheus text format
+//	GET /healthz  liveness: 200 while the node runs
+//	GET /readyz   readiness: 200 once the node recovered and caught up
+func (n *node) serveAdmin(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status, err := n.Status()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := n.metrics.write(w); err != nil {
+			n.logger.Warn("Failed to write metrics", "error", err)
+		}
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-n.done:
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "closed"})
+		default:
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		}
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !n.ready.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]bool{"ready": false})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ready": true})
+	})
+
+	n.admin = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := n.admin.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			n.logger.Error("Admin endpoint failed", "error", err)
+		}
+	}()
+	n.logger.Info("Serving admin endpoint", "address", l.Addr().String())
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// ErrDiverged is returned by Repair when a peer committed a different history
+// or holds a different state at the same position. Replaying commits cannot
+// fix that.
+var ErrDiverged = errors.New("replica diverged")
+
+// DefaultAntiEntropyInterval is how often nodes run from a ClusterConfig
+// compare themselves with their peers unless it sets otherwise.
+const DefaultAntiEntropyInterval = time.Minute
+
+type ReplicaStatus string
+
+const (
+	REPLICA_IN_SYNC     ReplicaStatus = "in_sync"
+	REPLICA_LAGGING     ReplicaStatus = "lagging"  // the peer misses commits this node has
+	REPLICA_AHEAD       ReplicaStatus = "ahead"    // the peer has commits this node misses
+	REPLICA_DIVERGED    ReplicaStatus = "diverged" // same position, different state or history
+	REPLICA_UNREACHABLE ReplicaStatus = "unreachable"
+)
+
+// Digest is the fingerprint of a node's committed state and history.
+type Digest struct {
+	NodeID int
+	store.Fingerprint
+}
+
+// ReplicaReport describes a peer as compared to this node.
+type ReplicaReport struct {
+	PeerID int
+	Status ReplicaStatus
+	Local  Digest
+	Remote Digest
+	Error  string
+}
+
+func (n *node) digest() (Digest, error) {
+	fingerprint, err := n.volatileStore.Fingerprint()
+	return Digest{NodeID: n.id, Fingerprint: fingerprint}, err
+}
+
+func (n *node) CheckConsistency() ([]ReplicaReport, error) {
+	local, err := n.digest()
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []ReplicaReport
+	for _, r := range Broadcast[Digest](n.peers, "Node.GetDigest", n.id) {
+		report := ReplicaReport{PeerID: r.PeerID, Local: local, Remote: r.Value}
+
+		switch remote := r.Value; {
+		case r.Err != nil:
+			report.Status = REPLICA_UNREACHABLE
+			report.Error = r.Err.Error()
+		case remote.Seq > local.Seq:
+			report.Status = REPLICA_AHEAD
+		case remote.Seq < local.Seq:
+			report.Status = REPLICA_LAGGING
+		case remote.Fingerprint != local.Fingerprint:
+			report.Status = REPLICA_DIVERGED
+		default:
+			report.Status = REPLICA_IN_SYNC
+		}
+
+		reports = append(reports, report)
+	}
+
+	slices.SortFunc(reports, func(a, b ReplicaReport) int { return a.PeerID - b.PeerID })
+	return reports, nil
+}
+
+func (n *node) Repair() error {
+	reports, err := n.CheckConsistency()
+	if err != nil {
+		return err
+	}
+
+	var source *ReplicaReport
+	var errs []error
+	for i, r := range reports {
+		switch r.Status {
+		case REPLICA_DIVERGED:
+			n.logger.Error("Replica diverged", "peer_id", r.PeerID, "seq", r.Local.Seq)
+			errs = append(errs, fmt.Errorf("%w: node %d at seq %d", ErrDiverged, r.PeerID, r.Local.Seq))
+		case REPLICA_AHEAD:
+			if source == nil || r.Remote.Seq > source.Remote.Seq {
+				source = &reports[i]
+			}
+		}
+	}
+
+	if source != nil {
+		n.logger.Info("Missing commits, catching up from peer", "peer_id", source.PeerID,
+			"local_seq", source.Local.Seq, "remote_seq", source.Remote.Seq)
+		if err := n.catchUp(n.peer(source.PeerID), source.Local.Seq); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (n *node) runAntiEntropy(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			if err := n.Repair(); err != nil {
+				n.logger.Warn("Anti-entropy round failed", "error", err)
+			}
+		}
+	}
+}
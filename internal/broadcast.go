@@ -11,6 +11,14 @@ type Result[T any] struct {
 	Err    error
 }
 
+// callTimeout bounds a call to p, even if p fails to enforce its timeouts.
+func callTimeout(p Peer) time.Duration {
+	if t, ok := p.(interface{ callTimeout() time.Duration }); ok {
+		return t.callTimeout()
+	}
+	return DefaultTimeouts.Dial + DefaultTimeouts.RPC
+}
+
 func Broadcast[T any](peers []Peer, method string, args any) []Result[T] {
 	resultsChan := make(chan Result[T], len(peers))
 
@@ -26,7 +34,7 @@ func Broadcast[T any](peers []Peer, method string, args any) []Result[T] {
 			select {
 			case err := <-done:
 				resultsChan <- Result[T]{PeerID: peer.ID(), Value: reply, Err: err}
-			case <-time.After(5 * time.Second): // Hard timeout
+			case <-time.After(callTimeout(peer)): // Hard timeout
 				resultsChan <- Result[T]{PeerID: peer.ID(), Err: errors.New("timeout")}
 			}
 		}(p)
@@ -0,0 +1,347 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidConfig is matched, through errors.Is, by every problem reported
+// when validating a ClusterConfig.
+var ErrInvalidConfig = errors.New("invalid cluster config")
+
+// PROTOCOL_TWO_PHASE_COMMIT is two-phase commit with presumed abort, the
+// protocol variant nodes run unless configured otherwise, and the only one
+// implemented.
+const PROTOCOL_TWO_PHASE_COMMIT = "2pc"
+
+// ClusterConfig describes a cluster: its nodes and the settings they share.
+// It is read from a YAML or JSON file with LoadClusterConfig.
+type ClusterConfig struct {
+	// Protocol is the protocol variant, PROTOCOL_TWO_PHASE_COMMIT if empty.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	// DataDir is the data directory of nodes that do not set their own.
+	DataDir  string         `json:"data_dir,omitempty" yaml:"data_dir,omitempty"`
+	Timeouts TimeoutsConfig `json:"timeouts,omitzero" yaml:"timeouts,omitempty"`
+	// TLS, when set, makes nodes talk to each other over mutual TLS.
+	TLS *TLSConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// Tracing, when set, makes nodes export the spans of transactions.
+	Tracing *TracingConfig `json:"tracing,omitempty" yaml:"tracing,omitempty"`
+	// Snapshots is the policy nodes snapshot their state and compact their
+	// WAL with in the background, DefaultSnapshotPolicy if unset. A section
+	// with every field zero disables background snapshots.
+	Snapshots *SnapshotsConfig `json:"snapshots,omitempty" yaml:"snapshots,omitempty"`
+	// AntiEntropy is how often nodes compare themselves with their peers,
+	// DefaultAntiEntropyInterval if unset and never if zero, see
+	// WithAntiEntropy.
+	AntiEntropy *Duration    `json:"anti_entropy,omitempty" yaml:"anti_entropy,omitempty"`
+	Nodes       []NodeConfig `json:"nodes" yaml:"nodes"`
+}
+
+// NodeConfig describes a node of a ClusterConfig.
+type NodeConfig struct {
+	ID int `json:"id" yaml:"id"`
+	// Address is where the other nodes and clients reach the node.
+	Address string `json:"address" yaml:"address"`
+	// Listen is the address the node binds, Address if empty, see
+	// WithListenAddress.
+	Listen string `json:"listen,omitempty" yaml:"listen,omitempty"`
+	// Admin, when set, is the address of the node's HTTP admin endpoint,
+	// see WithAdmin.
+	Admin   string `json:"admin,omitempty" yaml:"admin,omitempty"`
+	DataDir string `json:"data_dir,omitempty" yaml:"data_dir,omitempty"`
+	// KeyFile, when set, makes the node encrypt its WAL and snapshots with
+	// the keys of a store.FileKeyProvider kept in that file.
+	KeyFile string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+}
+
+// TimeoutsConfig is the Timeouts of a ClusterConfig. Unset fields keep
+// their default.
+type TimeoutsConfig struct {
+	Dial Duration `json:"dial,omitzero" yaml:"dial,omitempty"`
+	RPC  Duration `json:"rpc,omitzero" yaml:"rpc,omitempty"`
+}
+
+// SnapshotsConfig is the SnapshotPolicy of a ClusterConfig.
+type SnapshotsConfig struct {
+	Records  int      `json:"records,omitempty" yaml:"records,omitempty"`
+	Bytes    int64    `json:"bytes,omitempty" yaml:"bytes,omitempty"`
+	Interval Duration `json:"interval,omitzero" yaml:"interval,omitempty"`
+}
+
+// NewSnapshotsConfig returns the config of p.
+func NewSnapshotsConfig(p SnapshotPolicy) *SnapshotsConfig {
+	return &SnapshotsConfig{Records: p.Records, Bytes: p.Bytes, Interval: Duration(p.Interval)}
+}
+
+// Policy returns the SnapshotPolicy c describes.
+func (c *SnapshotsConfig) Policy() SnapshotPolicy {
+	return SnapshotPolicy{Records: c.Records, Bytes: c.Bytes, Interval: time.Duration(c.Interval)}
+}
+
+// TLSConfig locates the PEM files nodes use for mutual TLS.
+type TLSConfig struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+	// CAFile holds the certificates peers are verified against, on both
+	// sides of a connection. Without it, the system roots verify servers
+	// and clients are not asked for a certificate.
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+}
+
+// Span exporters a TracingConfig can name.
+const (
+	TRACING_EXPORTER_STDOUT = "stdout"
+	TRACING_EXPORTER_OTLP   = "otlp"
+)
+
+// TracingConfig selects where nodes export spans, see WithTracing.
+type TracingConfig struct {
+	// Exporter is TRACING_EXPORTER_STDOUT or TRACING_EXPORTER_OTLP.
+	Exporter string `json:"exporter" yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP traces URL, DefaultOTLPEndpoint if empty.
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+}
+
+// NewExporter returns the span exporter c selects.
+func (c *TracingConfig) NewExporter() (SpanExporter, error) {
+	switch c.Exporter {
+	case TRACING_EXPORTER_STDOUT:
+		return NewStdoutExporter(os.Stdout), nil
+	case TRACING_EXPORTER_OTLP:
+		return NewOTLPExporter(c.Endpoint), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown tracing exporter %q, use %q or %q", ErrInvalidConfig, c.Exporter, TRACING_EXPORTER_STDOUT, TRACING_EXPORTER_OTLP)
+	}
+}
+
+// Duration is a time.Duration written as a string such as "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// LoadClusterConfig reads and validates the cluster config in path. The
+// format follows the extension: .yaml or .yml for YAML, .json for JSON.
+// Unknown fields are rejected so typos do not go unnoticed.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c ClusterConfig
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&c)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&c)
+	default:
+		return nil, fmt.Errorf("unsupported cluster config format %q, use .yaml, .yml or .json", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Validate reports every problem of c, each matching ErrInvalidConfig.
+func (c *ClusterConfig) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidConfig}, args...)...))
+	}
+
+	if c.Protocol != "" && c.Protocol != PROTOCOL_TWO_PHASE_COMMIT {
+		invalid("unsupported protocol %q, only %q is implemented", c.Protocol, PROTOCOL_TWO_PHASE_COMMIT)
+	}
+	if c.Timeouts.Dial < 0 || c.Timeouts.RPC < 0 {
+		invalid("timeouts cannot be negative")
+	}
+	if c.Snapshots != nil && (c.Snapshots.Records < 0 || c.Snapshots.Bytes < 0 || c.Snapshots.Interval < 0) {
+		invalid("snapshots thresholds cannot be negative")
+	}
+	if c.AntiEntropy != nil && *c.AntiEntropy < 0 {
+		invalid("anti_entropy cannot be negative")
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		invalid("tls needs both cert_file and key_file")
+	}
+	if c.Tracing != nil && c.Tracing.Exporter != TRACING_EXPORTER_STDOUT && c.Tracing.Exporter != TRACING_EXPORTER_OTLP {
+		invalid("unknown tracing exporter %q, use %q or %q", c.Tracing.Exporter, TRACING_EXPORTER_STDOUT, TRACING_EXPORTER_OTLP)
+	}
+	if len(c.Nodes) == 0 {
+		invalid("no nodes")
+	}
+
+	ids := make(map[int]bool)
+	addresses := make(map[string]int)
+	for _, n := range c.Nodes {
+		if n.ID < 0 {
+			invalid("node %d: negative ID", n.ID)
+		}
+		if ids[n.ID] {
+			invalid("node %d is listed twice", n.ID)
+		}
+		ids[n.ID] = true
+
+		if n.Address == "" {
+			invalid("node %d has no address", n.ID)
+			continue
+		}
+		if other, ok := addresses[n.Address]; ok && other != n.ID {
+			invalid("nodes %d and %d share the address %s", other, n.ID, n.Address)
+		}
+		addresses[n.Address] = n.ID
+	}
+
+	return errors.Join(errs...)
+}
+
+// Addresses maps the ID of every node to its address, as expected by NewNode.
+func (c *ClusterConfig) Addresses() map[int]string {
+	addresses := make(map[int]string, len(c.Nodes))
+	for _, n := range c.Nodes {
+		addresses[n.ID] = n.Address
+	}
+	return addresses
+}
+
+// IDs returns the IDs of the nodes in ascending order.
+func (c *ClusterConfig) IDs() []int {
+	ids := make([]int, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		ids = append(ids, n.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Node returns the config of the node with id.
+func (c *ClusterConfig) Node(id int) (NodeConfig, bool) {
+	for _, n := range c.Nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return NodeConfig{}, false
+}
+
+// Options returns the options NewNode needs to run the node with id as c
+// describes it.
+func (c *ClusterConfig) Options(id int) ([]Option, error) {
+	n, ok := c.Node(id)
+	if !ok {
+		return nil, fmt.Errorf("node %d is not part of the cluster", id)
+	}
+
+	dataDir := n.DataDir
+	if dataDir == "" {
+		dataDir = c.DataDir
+	}
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+
+	snapshots := DefaultSnapshotPolicy
+	if c.Snapshots != nil {
+		snapshots = c.Snapshots.Policy()
+	}
+	antiEntropy := DefaultAntiEntropyInterval
+	if c.AntiEntropy != nil {
+		antiEntropy = time.Duration(*c.AntiEntropy)
+	}
+
+	opts := []Option{
+		WithDataDir(dataDir),
+		WithTimeouts(Timeouts{Dial: time.Duration(c.Timeouts.Dial), RPC: time.Duration(c.Timeouts.RPC)}),
+		WithSnapshotPolicy(snapshots),
+		WithAntiEntropy(antiEntropy),
+	}
+	if n.Listen != "" {
+		opts = append(opts, WithListenAddress(n.Listen))
+	}
+	if n.Admin != "" {
+		opts = append(opts, WithAdmin(n.Admin))
+	}
+	if n.KeyFile != "" {
+		keys, err := store.NewFileKeyProvider(n.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithEncryption(keys))
+	}
+	if c.TLS != nil {
+		tlsConfig, err := c.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithTLS(tlsConfig))
+	}
+	if c.Tracing != nil {
+		exporter, err := c.Tracing.NewExporter()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithTracing(exporter))
+	}
+
+	return opts, nil
+}
+
+// Load reads the certificates of c into a tls.Config that serves as both
+// the server and the client side of node connections, and of clients.
+func (c *TLSConfig) Load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of latency histograms.
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics are the counters and histograms of a node, served in the
+// Prometheus text format on the admin endpoint at /metrics. Transaction
+// counters and phase latencies only cover transactions the node coordinated.
+//
+// Prepares never wait for the transaction lock: a busy lock rejects them and
+// is counted in lock conflicts. What other transactions wait on is the time
+// the lock is held, from prepare to commit or abort.
+type metrics struct {
+	txStarted     *counterVec
+	txCommitted   *counterVec
+	txAborted     *counterVec
+	phaseDuration *histogramVec
+	peerErrors    *counterVec
+	walSync       *histogramVec
+	lockHold      *histogramVec
+	lockConflicts *counterVec
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		txStarted:     newCounterVec("twopc_transactions_started_total", "Transactions this node started as coordinator."),
+		txCommitted:   newCounterVec("twopc_transactions_committed_total", "Transactions this node coordinated that committed."),
+		txAborted:     newCounterVec("twopc_transactions_aborted_total", "Transactions this node coordinated that aborted, by reason.", "reason"),
+		phaseDuration: newHistogramVec("twopc_phase_duration_seconds", "Time taken by the prepare and commit broadcasts of coordinated transactions.", "phase"),
+		peerErrors:    newCounterVec("twopc_peer_rpc_errors_total", "Calls to peers that failed to reach them, by peer, method and kind (error or timeout).", "peer", "method", "kind"),
+		walSync:       newHistogramVec("twopc_wal_sync_duration_seconds", "Time taken to write and fsync a WAL record."),
+		lockHold:      newHistogramVec("twopc_lock_hold_seconds", "Time transactions held the lock, from prepare to commit or abort."),
+		lockConflicts: newCounterVec("twopc_lock_conflicts_total", "Prepares rejected because another transaction held the lock."),
+	}
+}
+
+// abortReason is the label of the error a coordinated transaction failed
+// with: the code of the node that voted no, or "error".
+func abortReason(err error) string {
+	var reason *RejectReason
+	if errors.As(err, &reason) {
+		return string(reason.Code)
+	}
+	return "error"
+}
+
+// observePeerError counts a call that did not reach peer.
+func (m *metrics) observePeerError(peer int, method string, err error) {
+	kind := "error"
+	var netErr net.Error
+	if errors.Is(err, errRPCTimeout) || errors.As(err, &netErr) && netErr.Timeout() {
+		kind = "timeout"
+	}
+	m.peerErrors.inc(strconv.Itoa(peer), method, kind)
+}
+
+func (m *metrics) write(w io.Writer) error {
+	for _, c := range []interface{ write(io.Writer) error }{
+		m.txStarted, m.txCommitted, m.txAborted, m.phaseDuration,
+		m.peerErrors, m.walSync, m.lockHold, m.lockConflicts,
+	} {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// series holds the label values of a metric, joined so they can key a map.
+type series string
+
+func seriesOf(values []string) series {
+	return series(strings.Join(values, "\xff"))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels formats the labels of s, with extra name and value pairs appended.
+func (s series) labels(names []string, extra ...string) string {
+	values := strings.Split(string(s), "\xff")
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[series]uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[series]uint64)}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[seriesOf(values)]++
+}
+
+func (c *counterVec) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name); err != nil {
+		return err
+	}
+	// A counter without labels is always exposed, even at zero.
+	if len(c.labels) == 0 {
+		_, err := fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return err
+	}
+	for _, s := range slices.Sorted(maps.Keys(c.values)) {
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", c.name, s.labels(c.labels), c.values[s]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[series]*histogram
+}
+
+type histogram struct {
+	// counts holds the observations of each bucket, not cumulated.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: make(map[series]*histogram)}
+}
+
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := seriesOf(values)
+	hist, ok := h.series[s]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		h.series[s] = hist
+	}
+
+	seconds := d.Seconds()
+	if i, _ := slices.BinarySearch(latencyBuckets, seconds); i < len(latencyBuckets) {
+		hist.counts[i]++
+	}
+	hist.sum += seconds
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name); err != nil {
+		return err
+	}
+	for _, s := range slices.Sorted(maps.Keys(h.series)) {
+		hist := h.series[s]
+
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += hist.counts[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, s.labels(h.labels, "le", le), cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %g\n%s_count%s %d\n",
+			h.name, s.labels(h.labels, "le", "+Inf"), hist.count,
+			h.name, s.labels(h.labels), hist.sum,
+			h.name, s.labels(h.labels), hist.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,12 +1,19 @@
 package internal
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log/slog"
+	"maps"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"slices"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -14,15 +21,61 @@ import (
 )
 
 type Node interface {
+	// Transaction adds value to the default Counter state machine.
 	Transaction(value int) error
+	// TransactionIf adds value to the default Counter state machine only if
+	// it still holds expected on every node.
+	TransactionIf(expected, value int) error
+	// Submit runs a transaction carrying an arbitrary state machine command
+	// and returns its ID.
+	Submit(cmd []byte) (uuid.UUID, error)
+	// SubmitIf is Submit conditioned on every node's state machine snapshot
+	// being equal to expected. It fails with an error matching
+	// ErrPreconditionFailed otherwise.
+	SubmitIf(expected, cmd []byte) (uuid.UUID, error)
+	// State returns the value of the default Counter state machine.
 	State() int
+	StateMachine() store.StateMachine
+	// Read returns a snapshot of the state machine that is consistent with
+	// the rest of the cluster, see read.go.
+	Read() ([]byte, error)
+	// ReadAt returns the state machine snapshot as of commit sequence number
+	// seq, as long as that version was not garbage collected.
+	ReadAt(seq uint64) ([]byte, error)
+	// Versions returns the retained versions, oldest first.
+	Versions() []store.Version
+	// CommitIndex reports how far this node is in the total order of
+	// committed transactions.
+	CommitIndex() CommitIndex
+	// TakeSnapshot snapshots the state and compacts the WAL now, see
+	// snapshot.go.
+	TakeSnapshot() (SnapshotInfo, error)
+	// LastSnapshot describes the last snapshot the node took.
+	LastSnapshot() SnapshotInfo
+	// CheckConsistency compares this node's committed state and history
+	// with every peer, see anti_entropy.go.
+	CheckConsistency() ([]ReplicaReport, error)
+	// Repair catches this node up with the most advanced peer, see
+	// state_transfer.go.
+	Repair() error
+	// Status describes the node for introspection, see admin.go.
+	Status() (NodeStatus, error)
+	// RegisterValidator adds a hook run on this node whenever it prepares a
+	// transaction, as coordinator or participant.
+	RegisterValidator(v Validator)
 	Close() error
 
-	prepare(txID uuid.UUID, value, senderID int) error
-	commit(txID uuid.UUID, value, senderID int) error
-	abort(txID uuid.UUID, senderID int) error
-	checkResult(result []Result[bool]) bool
+	prepare(txID uuid.UUID, cmd, expected []byte, senderID int, participants []int) error
+	commit(txID uuid.UUID, cmd []byte, senderID int, participants []int) error
+	abort(txID uuid.UUID, senderID int, participants []int) error
+	checkResult(result []Result[PrepareReply]) error
 	recover() error
+	digest() (Digest, error)
+	stateTransfer(after uint64) (StateTransfer, error)
+	snapshotChunk(args SnapshotChunkArgs) (SnapshotChunk, error)
+	advanceWatermark(watermark uint64)
+	checkStale(baseSeq uint64) error
+	traceTransaction(txID uuid.UUID, tc TraceContext) (release func())
 	getStatus(txID uuid.UUID) (store.TransactionState, error)
 }
 
@@ -32,14 +85,64 @@ type node struct {
 	peers         []Peer
 	stableStore   store.StableStore
 	volatileStore store.VolatileStore
-	listener      net.Listener
-	logger        *slog.Logger
+	stateMachine  store.StateMachine
+	// versionRetention is the number of versions kept by each snapshot.
+	versionRetention int
+	listener         net.Listener
+	logger           *slog.Logger
+
+	validatorsMu sync.RWMutex
+	validators   []Validator
+
+	// pending holds the PREPARED record of every transaction this node
+	// voted yes for and has not learned the outcome of yet.
+	pendingMu sync.Mutex
+	pending   map[uuid.UUID]store.Entry
+
+	commitMu sync.Mutex
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	metrics *metrics
+	// tracer records spans, nil unless configured with WithTracing.
+	tracer *tracer
+
+	// snapshotMu serialises snapshots, and lastSnapshot describes the last
+	// one taken.
+	snapshotMu     sync.Mutex
+	lastSnapshotMu sync.Mutex
+	lastSnapshot   SnapshotInfo
+
+	// streams holds the snapshots being streamed to peers, see
+	// state_transfer.go.
+	streamsMu    sync.Mutex
+	streams      map[uint64]*snapshotStream
+	lastStreamID uint64
+
+	// done is closed when the node shuts down, stopping background work.
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// ready is set once the node recovered and caught up with its peers.
+	ready atomic.Bool
+	// admin is the admin endpoint, nil unless configured with WithAdmin.
+	admin *http.Server
 }
 
 func (n *node) Close() error {
 	n.logger.Info("Shutting down node")
+	n.closeOnce.Do(func() { close(n.done) })
+	n.ready.Store(false)
 	var errs []error
 
+	if n.admin != nil {
+		n.logger.Info("Closing admin endpoint")
+		if err := n.admin.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	if n.listener != nil {
 		n.logger.Info("Closing TCP listener", "address", n.address)
 		if err := n.listener.Close(); err != nil {
@@ -48,6 +151,22 @@ func (n *node) Close() error {
 		}
 	}
 
+	// A closed node must stop answering, including on connections peers
+	// opened before it was closed.
+	n.connsMu.Lock()
+	n.logger.Info("Closing inbound connections", "count", len(n.conns))
+	for conn := range n.conns {
+		conn.Close()
+	}
+	n.connsMu.Unlock()
+
+	n.streamsMu.Lock()
+	streams := slices.Collect(maps.Keys(n.streams))
+	n.streamsMu.Unlock()
+	for _, id := range streams {
+		n.closeSnapshotStream(id)
+	}
+
 	n.logger.Info("Closing connections to peers", "count", len(n.peers))
 	for _, p := range n.peers {
 		if err := p.Close(); err != nil {
@@ -62,6 +181,10 @@ func (n *node) Close() error {
 		errs = append(errs, err)
 	}
 
+	// Spans are flushed last, once peers and the store are closed, so the
+	// spans of transactions failing on them are exported as well.
+	n.tracer.close()
+
 	if len(errs) > 0 {
 		return errs[0]
 	}
@@ -70,7 +193,22 @@ func (n *node) Close() error {
 	return nil
 }
 
+// getStatus reports a transaction as this node sees it. A transaction the
+// node voted yes for, or is still preparing as coordinator, is PREPARED:
+// its outcome is not decided yet, and presuming it aborted would let an
+// in-doubt participant abort what the coordinator then commits.
 func (n *node) getStatus(txID uuid.UUID) (store.TransactionState, error) {
+	if n.isPending(txID) {
+		return store.TRANSACTION_PREPARED, nil
+	}
+
+	// Compaction drops COMMITTED records from the WAL once they are part of
+	// a snapshot, so the committed history has to be consulted as well.
+	// Transactions pruned from it were acknowledged by every node, so no
+	// peer is left to ask about them.
+	if n.volatileStore.IsCommitted(txID) {
+		return store.TRANSACTION_COMMITTED, nil
+	}
 	return n.stableStore.GetTransactionState(txID)
 }
 
@@ -81,22 +219,27 @@ func (n *node) recover() error {
 		return err
 	}
 
-	rebuiltState := 0
-	rebuiltHistory := make(map[uuid.UUID]bool)
-
 	if snapshot != nil {
-		rebuiltState = snapshot.State
-		rebuiltHistory = snapshot.CommittedLog
-		n.logger.Info("Loaded snapshot", "state", rebuiltState)
+		n.logger.Info("Loaded snapshot", "size", len(snapshot.State), "seq", snapshot.Seq, "committed", len(snapshot.CommittedLog))
+	}
+
+	if err := n.volatileStore.Recover(snapshot); err != nil {
+		return err
 	}
 
-	var lastTx *store.Entry
+	// latest holds the most recent record of every transaction in the log,
+	// and order the transactions in the order they first appeared.
+	latest := make(map[uuid.UUID]store.Entry)
+	var order []uuid.UUID
 
 	err = n.stableStore.ReplayLog(func(e store.Entry) error {
-		lastTx = &e
+		if _, seen := latest[e.TxID]; !seen {
+			order = append(order, e.TxID)
+		}
+		latest[e.TxID] = e
+
 		if e.State == store.TRANSACTION_COMMITTED {
-			rebuiltState = e.Value
-			rebuiltHistory[e.TxID] = true
+			return n.volatileStore.Replay(e)
 		}
 		return nil
 	})
@@ -104,215 +247,611 @@ func (n *node) recover() error {
 		return err
 	}
 
-	n.volatileStore.Recover(rebuiltState, rebuiltHistory)
+	var inDoubt []store.Entry
+	for _, txID := range order {
+		// A snapshot installed from a peer may hold the outcome the log
+		// lacks.
+		if e := latest[txID]; e.State == store.TRANSACTION_PREPARED && !n.volatileStore.IsCommitted(txID) {
+			inDoubt = append(inDoubt, e)
+		}
+	}
 
-	if lastTx != nil && lastTx.State == store.TRANSACTION_PREPARED {
-		n.logger.Warn("Found transaction in PREPARED state during recovery. Attempting resolution.", "txID", lastTx.TxID)
-		n.volatileStore.Prepare(lastTx.TxID, lastTx.Value)
-		go n.resolveAnomaly(lastTx.TxID, lastTx.SenderID, lastTx.Value)
+	for _, e := range inDoubt {
+		n.logger.Warn("Found transaction in PREPARED state during recovery. Attempting resolution.",
+			"txID", e.TxID, "coordinator_id", e.SenderID, "participants", e.Participants)
+		n.volatileStore.Reacquire(e.TxID, e.Command)
+		n.trackPending(e)
 	}
 
-	if err := n.stableStore.SaveSnapshot(n.volatileStore.State(), n.volatileStore.GetCommittedHistory()); err != nil {
+	if err := n.snapshot(inDoubt); err != nil {
 		return err
 	}
-	return n.stableStore.Truncate()
+
+	for _, e := range inDoubt {
+		go n.resolveAnomaly(e)
+	}
+	return nil
 }
 
-func (n *node) resolveAnomaly(txID uuid.UUID, senderID int, value int) {
-	logger := n.logger.With("txID", txID, "process", "anomaly_resolution")
+// snapshot persists the current state, compacts the WAL down to the given
+// records and garbage collects the versions outside the retention window.
+// Nothing may write to the WAL meanwhile; at runtime, see TakeSnapshot.
+func (n *node) snapshot(keep []store.Entry) error {
+	stats, err := n.stableStore.Stats()
+	if err != nil {
+		return err
+	}
+	data, err := n.volatileStore.Checkpoint()
+	if err != nil {
+		return err
+	}
+	data.LSN = stats.LastLSN
 
-	if senderID == n.id {
-		logger.Info("Coordinator recovered, aborting own incomplete transaction")
-		n.abort(txID, senderID)
-		return
+	if err := n.stableStore.SaveSnapshot(*data); err != nil {
+		return err
+	}
+	if err := n.stableStore.Truncate(keep...); err != nil {
+		return err
+	}
+
+	n.volatileStore.PruneVersions(n.versionRetention)
+	n.setLastSnapshot(SnapshotInfo{LSN: data.LSN, Seq: data.Seq, Taken: time.Now()})
+	return nil
+}
+
+// participantPeers returns the peers that took part in a transaction. Records
+// written before participant sets were persisted carry none, in which case
+// every known peer is assumed to be a participant.
+func (n *node) participantPeers(participants []int) []Peer {
+	if len(participants) == 0 {
+		return n.peers
 	}
 
-	var coordinator Peer
+	peers := make([]Peer, 0, len(participants))
 	for _, p := range n.peers {
-		if p.ID() == senderID {
-			coordinator = p
-			break
+		if slices.Contains(participants, p.ID()) {
+			peers = append(peers, p)
 		}
 	}
+	return peers
+}
 
+func (n *node) peer(id int) Peer {
+	for _, p := range n.peers {
+		if p.ID() == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// participantIDs returns the sorted IDs of every node in the cluster,
+// including this one.
+func (n *node) participantIDs() []int {
+	ids := make([]int, 0, len(n.peers)+1)
+	ids = append(ids, n.id)
+	for _, p := range n.peers {
+		ids = append(ids, p.ID())
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func (n *node) resolveAnomaly(entry store.Entry) {
+	txID, senderID := entry.TxID, entry.SenderID
+	logger := n.logger.With("txID", txID, "process", "anomaly_resolution")
+
+	if senderID == n.id {
+		logger.Info("Coordinator recovered, aborting own incomplete transaction")
+		n.abort(txID, senderID, entry.Participants)
+		Broadcast[bool](n.participantPeers(entry.Participants), "Node.Abort", RequestArgs{
+			TxID:         txID,
+			SenderID:     senderID,
+			Participants: entry.Participants,
+		})
+		return
+	}
+
+	coordinator := n.peer(senderID)
 	if coordinator == nil {
 		logger.Error("Coordinator not found in peer list, aborting", "coordinator_id", senderID)
-		n.abort(txID, senderID)
+		n.abort(txID, senderID, entry.Participants)
 		return
 	}
 
+	// A coordinator still in its prepare phase answers PREPARED: it is
+	// asked again, sooner than an unreachable one, until it decides.
+	backoff := 100 * time.Millisecond
 	for {
 		var status store.TransactionState
 		err := coordinator.Call("Node.GetStatus", txID, &status)
 
+		if err == nil && status == store.TRANSACTION_PREPARED {
+			logger.Info("Coordinator has not decided yet, retrying", "backoff", backoff)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, 2*time.Second)
+			continue
+		}
 		if err == nil {
 			logger.Info("Fetched status from coordinator", "status", status)
 			if status == store.TRANSACTION_COMMITTED {
-				n.commit(txID, value, senderID)
+				n.commit(txID, entry.Command, senderID, entry.Participants)
 			} else {
-				n.abort(txID, senderID)
+				n.abort(txID, senderID, entry.Participants)
 			}
 			return
 		}
 
-		logger.Warn("Failed to contact coordinator, retrying...", "error", err)
+		logger.Warn("Failed to contact coordinator, asking other participants", "error", err)
+
+		// A participant only ever records COMMITTED after the coordinator
+		// decided to commit, so a single positive answer is enough. Negative
+		// answers are not conclusive (presumed abort) and are ignored.
+		if n.committedByParticipant(txID, senderID, entry.Participants) {
+			logger.Info("Another participant committed the transaction")
+			n.commit(txID, entry.Command, senderID, entry.Participants)
+			return
+		}
+
 		time.Sleep(2 * time.Second)
 	}
 }
 
-func (n *node) abort(txID uuid.UUID, senderID int) error {
+func (n *node) committedByParticipant(txID uuid.UUID, coordinatorID int, participants []int) bool {
+	peers := slices.DeleteFunc(slices.Clone(n.participantPeers(participants)), func(p Peer) bool {
+		return p.ID() == coordinatorID
+	})
+
+	for _, r := range Broadcast[store.TransactionState](peers, "Node.GetStatus", txID) {
+		if r.Err == nil && r.Value == store.TRANSACTION_COMMITTED {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *node) abort(txID uuid.UUID, senderID int, participants []int) (err error) {
 	logger := n.logger.With("txID", txID, "process", "abort")
 
+	span := n.tracer.start("2pc.Abort", n.tracer.transactionTrace(txID), "tx.id", txID)
+	defer func() { span.end(err) }()
+
 	logger.Info("Aborting transaction")
-	if err := n.stableStore.WriteAborted(txID, senderID); err != nil {
+	walSpan := n.tracer.start("wal.WriteAborted", span.context())
+	err = n.stableStore.WriteAborted(txID, senderID, participants)
+	walSpan.end(err)
+	if err != nil {
 		return err
 	}
 
 	if err := n.volatileStore.Abort(txID); err != nil {
 		return err
 	}
+	n.untrackPending(txID)
 
 	return nil
 }
 
-func (n *node) prepare(txID uuid.UUID, value, senderID int) error {
+func (n *node) prepare(txID uuid.UUID, cmd, expected []byte, senderID int, participants []int) (err error) {
 	logger := n.logger.With("txID", txID, "process", "prepare")
 
-	logger.Debug("Preparing transaction", "value", value)
-	if err := n.volatileStore.Prepare(txID, value); err != nil {
+	span := n.tracer.start("2pc.Prepare", n.tracer.transactionTrace(txID), "tx.id", txID, "tx.coordinator", senderID)
+	defer func() { span.end(err) }()
+
+	// A retransmitted prepare of a transaction this node already voted yes
+	// on gets the same vote. Validating it again could reject it and release
+	// the lock the coordinator is counting on.
+	if n.isPending(txID) {
+		logger.Debug("Transaction already prepared, voting yes again")
+		return nil
+	}
+
+	logger.Debug("Preparing transaction", "command_size", len(cmd), "conditional", expected != nil)
+	if err := n.volatileStore.PrepareIf(txID, cmd, expected); err != nil {
 		logger.Warn("Prepare failed in volatile store", "error", err)
-		return err
+		if errors.Is(err, store.ErrLocked) {
+			n.metrics.lockConflicts.inc()
+		}
+		return newRejectReason(n.id, REJECT_INVALID_COMMAND, err)
+	}
+
+	if err := n.validate(txID, cmd); err != nil {
+		reason := newRejectReason(n.id, REJECT_VALIDATION_FAILED, err)
+		logger.Warn("Validation hook rejected transaction", "code", reason.Code, "reason", reason.Message)
+		n.volatileStore.Abort(txID)
+		return reason
 	}
 
-	if err := n.stableStore.WritePrepared(txID, value, senderID); err != nil {
+	// The transaction is tracked before its record is written, so a
+	// concurrent compaction that drops the record keeps it anyway.
+	n.trackPending(store.Entry{
+		TxID:         txID,
+		State:        store.TRANSACTION_PREPARED,
+		SenderID:     senderID,
+		Command:      cmd,
+		Participants: participants,
+		Timestamp:    time.Now(),
+	})
+
+	walSpan := n.tracer.start("wal.WritePrepared", span.context())
+	err = n.stableStore.WritePrepared(txID, cmd, senderID, participants)
+	walSpan.end(err)
+	if err != nil {
 		logger.Error("WAL write failed during prepare", "error", err)
-		if err := n.abort(txID, senderID); err != nil {
-			return err
+		if abortErr := n.abort(txID, senderID, participants); abortErr != nil {
+			logger.Error("Failed to abort transaction after WAL failure", "error", abortErr)
 		}
-		return err
+		return newRejectReason(n.id, REJECT_STORAGE_FAILURE, fmt.Errorf("write prepared record: %w", err))
 	}
+	return nil
+}
+
+func (n *node) RegisterValidator(v Validator) {
+	n.validatorsMu.Lock()
+	defer n.validatorsMu.Unlock()
+	n.validators = append(n.validators, v)
+}
+
+// validate runs the registered hooks in registration order and stops at the
+// first rejection.
+func (n *node) validate(txID uuid.UUID, cmd []byte) error {
+	n.validatorsMu.RLock()
+	defer n.validatorsMu.RUnlock()
 
+	for _, v := range n.validators {
+		if err := v(txID, cmd, n.stateMachine); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (n *node) commit(txID uuid.UUID, value, senderID int) error {
+// ErrNotPrepared is returned by a node asked to commit a transaction it
+// holds no prepared record of.
+var ErrNotPrepared = errors.New("invalid transaction commit: transaction is not prepared")
+
+func (n *node) commit(txID uuid.UUID, cmd []byte, senderID int, participants []int) (err error) {
 	logger := n.logger.With("txID", txID, "process", "commit")
 
-	logger.Info("Committing transaction", "final_value", value)
-	if err := n.stableStore.WriteCommited(txID, value, senderID); err != nil {
-		n.abort(txID, senderID)
+	span := n.tracer.start("2pc.Commit", n.tracer.transactionTrace(txID), "tx.id", txID, "tx.coordinator", senderID)
+	defer func() { span.end(err) }()
+
+	// Commits are serialised so that sequence numbers are handed out in the
+	// order transactions are applied.
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+
+	if n.volatileStore.IsCommitted(txID) {
+		return nil
+	}
+
+	// Without a prepared record the transaction either never reached this
+	// node or committed long enough ago to be pruned from the history. The
+	// commit is refused so the coordinator does not count this node as
+	// having applied it.
+	if !n.isPending(txID) {
+		logger.Warn("Refusing commit of a transaction that is not prepared")
+		return ErrNotPrepared
+	}
+
+	lastSeq, _ := n.volatileStore.LastCommitted()
+	seq := lastSeq + 1
+
+	logger.Info("Committing transaction", "command_size", len(cmd), "seq", seq)
+	walSpan := n.tracer.start("wal.WriteCommitted", span.context(), "tx.seq", seq)
+	err = n.stableStore.WriteCommited(txID, cmd, seq, senderID, participants)
+	walSpan.end(err)
+	if err != nil {
+		n.abort(txID, senderID, participants)
 		return err
 	}
 
-	if err := n.volatileStore.Commit(txID); err != nil {
+	if err := n.volatileStore.Commit(store.Entry{
+		TxID:         txID,
+		SenderID:     senderID,
+		Seq:          seq,
+		Participants: participants,
+	}); err != nil {
 		return err
 	}
+	n.untrackPending(txID)
 
 	return nil
 }
 
+func (n *node) trackConn(conn net.Conn) {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	n.conns[conn] = struct{}{}
+}
+
+func (n *node) untrackConn(conn net.Conn) {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+	delete(n.conns, conn)
+}
+
+func (n *node) trackPending(e store.Entry) {
+	n.pendingMu.Lock()
+	defer n.pendingMu.Unlock()
+	n.pending[e.TxID] = e
+}
+
+// untrackPending forgets a transaction whose outcome is known, which
+// releases its lock.
+func (n *node) untrackPending(txID uuid.UUID) {
+	n.pendingMu.Lock()
+	e, ok := n.pending[txID]
+	delete(n.pending, txID)
+	n.pendingMu.Unlock()
+
+	if ok && !e.Timestamp.IsZero() {
+		n.metrics.lockHold.observe(time.Since(e.Timestamp))
+	}
+}
+
+func (n *node) isPending(txID uuid.UUID) bool {
+	n.pendingMu.Lock()
+	defer n.pendingMu.Unlock()
+	_, ok := n.pending[txID]
+	return ok
+}
+
+func (n *node) pendingTransactions() []store.Entry {
+	n.pendingMu.Lock()
+	defer n.pendingMu.Unlock()
+	return slices.Collect(maps.Values(n.pending))
+}
+
 func (n *node) State() int {
-	return n.volatileStore.State()
+	if counter, ok := n.stateMachine.(*store.Counter); ok {
+		return counter.Value()
+	}
+	return 0
+}
+
+func (n *node) StateMachine() store.StateMachine {
+	return n.stateMachine
+}
+
+func (n *node) ReadAt(seq uint64) ([]byte, error) {
+	version, err := n.volatileStore.ReadAt(seq)
+	if err != nil {
+		return nil, err
+	}
+	return version.State, nil
+}
+
+func (n *node) Versions() []store.Version {
+	return n.volatileStore.Versions()
 }
 
-func (n *node) checkResult(result []Result[bool]) bool {
-	success := true
+func (n *node) CommitIndex() CommitIndex {
+	seq, txID := n.volatileStore.LastCommitted()
+	return CommitIndex{NodeID: n.id, Seq: seq, LastTxID: txID, Watermark: n.volatileStore.Watermark()}
+}
+
+// checkResult returns the reasons every peer that did not vote yes gave,
+// joined, or nil if the vote was unanimous. Peers that could not be reached
+// are reported as REJECT_UNREACHABLE.
+func (n *node) checkResult(result []Result[PrepareReply]) error {
+	var reasons []error
 	for _, v := range result {
 		if v.Err != nil {
 			n.logger.Warn("Peer returned error", "peer_id", v.PeerID, "error", v.Err)
-			success = false
-		} else if v.Value == false {
-			n.logger.Warn("Peer rejected transaction", "peer_id", v.PeerID)
-			success = false
+			reasons = append(reasons, &RejectReason{NodeID: v.PeerID, Code: REJECT_UNREACHABLE, Message: v.Err.Error()})
+		} else if !v.Value.Vote {
+			reason := v.Value.Reason
+			if reason == nil {
+				reason = &RejectReason{NodeID: v.PeerID, Code: REJECT_VALIDATION_FAILED, Message: "no reason given"}
+			}
+			n.logger.Warn("Peer rejected transaction", "peer_id", v.PeerID, "code", reason.Code, "reason", reason.Message)
+			reasons = append(reasons, reason)
 		}
 	}
 
-	return success
+	return errors.Join(reasons...)
 }
 
 func (n *node) Transaction(value int) error {
+	if _, ok := n.stateMachine.(*store.Counter); !ok {
+		return errors.New("transaction requires the Counter state machine, use Submit")
+	}
+
+	n.logger.Info("Initiating counter transaction", "delta", value)
+	_, err := n.Submit(store.CounterAdd(value))
+	return err
+}
+
+func (n *node) TransactionIf(expected, value int) error {
+	if _, ok := n.stateMachine.(*store.Counter); !ok {
+		return errors.New("transaction requires the Counter state machine, use SubmitIf")
+	}
+
+	n.logger.Info("Initiating conditional counter transaction", "expected", expected, "delta", value)
+	_, err := n.SubmitIf(store.EncodeCounterState(expected), store.CounterAdd(value))
+	return err
+}
+
+func (n *node) Submit(cmd []byte) (uuid.UUID, error) {
+	return n.SubmitIf(nil, cmd)
+}
+
+func (n *node) SubmitIf(expected, cmd []byte) (uuid.UUID, error) {
 	txID, err := uuid.NewUUID()
 	if err != nil {
-		return err
+		return uuid.Nil, err
+	}
+
+	n.metrics.txStarted.inc()
+	if err := n.runTransaction(txID, cmd, expected); err != nil {
+		n.metrics.txAborted.inc(abortReason(err))
+		return txID, err
 	}
+	n.metrics.txCommitted.inc()
+	return txID, nil
+}
 
+func (n *node) runTransaction(txID uuid.UUID, cmd, expected []byte) (err error) {
 	logger := n.logger.With("txID", txID, "coordinator", n.id)
-	logger.Info("Initiating transaction", "delta", value)
+	logger.Info("Initiating transaction", "command_size", len(cmd))
+
+	// The transaction span is the root of the trace: the prepare, commit and
+	// abort spans of every participant, this node included, are its children.
+	span := n.tracer.start("2pc.Transaction", TraceContext{}, "tx.id", txID, "tx.coordinator", n.id)
+	defer func() { span.end(err) }()
+	defer n.tracer.traceTransaction(txID, span.context())()
 
-	computedValue := n.volatileStore.State() + value
+	participants := n.participantIDs()
 
 	// --- PHASE 1: PREPARE ---
-	if err := n.prepare(txID, computedValue, n.id); err != nil {
-		n.abort(txID, n.id)
-		return errors.New("coordinator is busy/locked")
+	if err := n.prepare(txID, cmd, expected, n.id, participants); err != nil {
+		n.abort(txID, n.id, participants)
+		if errors.Is(err, ErrPreconditionFailed) {
+			return fmt.Errorf("transaction precondition failed: %w", err)
+		}
+		return fmt.Errorf("coordinator rejected transaction: %w", err)
 	}
+	// The prepared transaction holds the lock, so no commit lands between
+	// the base and the prepares participants check it against.
+	baseSeq, _ := n.volatileStore.LastCommitted()
 
 	transactionArgs := RequestArgs{
-		TxID:     txID,
-		Value:    computedValue,
-		SenderID: n.id,
+		TxID:         txID,
+		Command:      cmd,
+		Expected:     expected,
+		SenderID:     n.id,
+		Participants: participants,
+		BaseSeq:      baseSeq,
+		Watermark:    n.volatileStore.Watermark(),
+		Trace:        span.context(),
 	}
 
-	prepareResults := Broadcast[bool](n.peers, "Node.Prepare", transactionArgs)
-	if !n.checkResult(prepareResults) {
+	start := time.Now()
+	prepareResults := Broadcast[PrepareReply](n.peers, "Node.Prepare", transactionArgs)
+	n.metrics.phaseDuration.observe(time.Since(start), "prepare")
+	if err := n.checkResult(prepareResults); err != nil {
 		logger.Warn("Consensus failed in Phase 1 (Prepare). Broadcasting Abort.")
-		Broadcast[bool](n.peers, "Node.Abort", RequestArgs{TxID: txID})
-		n.abort(txID, n.id)
-		return errors.New("consensus failed: a peer rejected or failed")
+		Broadcast[bool](n.peers, "Node.Abort", RequestArgs{TxID: txID, SenderID: n.id, Participants: participants, Trace: span.context()})
+		n.abort(txID, n.id, participants)
+		if errors.Is(err, ErrPreconditionFailed) {
+			return fmt.Errorf("transaction precondition failed: %w", err)
+		}
+		return fmt.Errorf("consensus failed: %w", err)
 	}
 
 	// --- PHASE 2: COMMIT ---
-	if err := n.commit(txID, computedValue, n.id); err != nil {
+	if err := n.commit(txID, cmd, n.id, participants); err != nil {
 		logger.Error("Critical: Failed to commit on coordinator")
 		return err // rare critical failure and unsolved in this project/protocol
 	}
 
-	Broadcast[bool](n.peers, "Node.Commit", transactionArgs)
+	start = time.Now()
+	commitResults := Broadcast[bool](n.peers, "Node.Commit", transactionArgs)
+	n.metrics.phaseDuration.observe(time.Since(start), "commit")
+	n.observeCommitAcks(txID, commitResults)
 	logger.Info("Transaction successfully committed")
 	return nil
 }
 
-func NewNode(id int, nodes map[int]string) (Node, error) {
-	port := 3000 + id
-	address := "localhost:" + strconv.Itoa(port)
+func NewNode(id int, nodes map[int]string, opts ...Option) (Node, error) {
+	o := options{dataDir: DefaultDataDir, versionRetention: DefaultVersionRetention, timeouts: DefaultTimeouts}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// A node is reached at its own entry of nodes, which defaults to the
+	// port the simulation gives it.
+	address, ok := nodes[id]
+	if !ok {
+		address = "localhost:" + strconv.Itoa(3000+id)
+	}
+	listenAddress := o.listenAddress
+	if listenAddress == "" {
+		listenAddress = address
+	}
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	logger = logger.With("node_id", id)
 
+	m := newMetrics()
+
 	peers := make([]Peer, 0, len(nodes))
 	for peerId, peerAddress := range nodes {
 		if id != peerId && address != peerAddress {
-			peer := NewPeer(peerId, peerAddress, logger)
+			peer := newPeer(peerId, peerAddress, o.timeouts, o.tlsConfig, logger, m)
 			peers = append(peers, peer)
 		}
 	}
 
-	stableStore, err := store.NewStableStore(id)
-	if err != nil {
-		return nil, err
+	stableStore := o.stableStore
+	if stableStore == nil {
+		storeOpts := append(o.storeOptions(), store.WithSyncObserver(func(d time.Duration) {
+			m.walSync.observe(d)
+		}))
+
+		var err error
+		if stableStore, err = store.NewStableStore(o.dataDir, id, storeOpts...); err != nil {
+			return nil, err
+		}
 	}
 
-	volatileStore := store.NewVolatileStore(0)
+	stateMachine := o.stateMachine
+	if stateMachine == nil {
+		stateMachine = store.NewCounter(0)
+	}
+	volatileStore := store.NewVolatileStore(stateMachine)
 
-	l, err := net.Listen("tcp", address)
+	l, err := net.Listen("tcp", listenAddress)
 	if err != nil {
+		stableStore.Close()
 		return nil, err
 	}
+	if o.tlsConfig != nil {
+		l = tls.NewListener(l, o.tlsConfig)
+	}
+
+	var t *tracer
+	if o.spanExporter != nil {
+		t = newTracer(id, o.spanExporter, logger)
+	}
 
 	n := &node{
-		id:            id,
-		address:       address,
-		peers:         peers,
-		stableStore:   stableStore,
-		volatileStore: volatileStore,
-		listener:      l,
-		logger:        logger,
+		id:               id,
+		address:          address,
+		peers:            peers,
+		stableStore:      stableStore,
+		volatileStore:    volatileStore,
+		stateMachine:     stateMachine,
+		versionRetention: o.versionRetention,
+		pending:          make(map[uuid.UUID]store.Entry),
+		conns:            make(map[net.Conn]struct{}),
+		streams:          make(map[uint64]*snapshotStream),
+		done:             make(chan struct{}),
+		metrics:          m,
+		tracer:           t,
+		listener:         l,
+		logger:           logger,
 	}
 
 	if err := n.recover(); err != nil {
+		l.Close()
+		stableStore.Close()
+		t.close()
 		return nil, err
 	}
 
+	// The admin endpoint reports the node live, but not ready, while it
+	// catches up.
+	if o.adminAddress != "" {
+		if err := n.serveAdmin(o.adminAddress); err != nil {
+			l.Close()
+			stableStore.Close()
+			t.close()
+			return nil, err
+		}
+	}
+
 	nodeRPC := newNodeRPC(n)
 
 	server := rpc.NewServer()
@@ -324,9 +863,28 @@ func NewNode(id int, nodes map[int]string) (Node, error) {
 			if err != nil {
 				return
 			}
-			go server.ServeConn(conn)
+			n.trackConn(conn)
+			go func() {
+				server.ServeConn(conn)
+				n.untrackConn(conn)
+			}()
 		}
 	}()
 
+	// A node returning from downtime catches up with the commits it missed
+	// before serving its first transaction.
+	if err := n.Repair(); err != nil {
+		n.logger.Warn("Catch-up at startup failed", "error", err)
+	}
+	n.ready.Store(true)
+
+	if o.snapshotPolicy.enabled() {
+		go n.runSnapshotPolicy(o.snapshotPolicy)
+	}
+
+	if o.antiEntropyInterval > 0 {
+		go n.runAntiEntropy(o.antiEntropyInterval)
+	}
+
 	return n, nil
 }
@@ -1,21 +1,77 @@
 package internal
 
 import (
+	"errors"
+
 	"github.com/google/uuid"
 	"github.com/rodrigocitadin/two-phase-commit/internal/store"
 )
 
 type RequestArgs struct {
-	TxID     uuid.UUID
-	Value    int
-	SenderID int
+	TxID    uuid.UUID
+	Command []byte
+	// Expected, when set, is the state machine snapshot the transaction is
+	// conditioned on.
+	Expected     []byte
+	SenderID     int
+	Participants []int
+	// BaseSeq is the coordinator's commit sequence number when it started
+	// the transaction. A prepare based below the receiver's watermark is a
+	// duplicate of a transaction whose history was already pruned.
+	BaseSeq uint64
+	// Watermark is the commit sequence number every node is known to have
+	// reached, piggybacked so participants can prune their history.
+	Watermark uint64
+	// Trace is the coordinator's span for the transaction, parent of the
+	// spans the receiver records for it. It is zero when tracing is off.
+	Trace TraceContext
+}
+
+// PrepareReply is a participant's vote. Rejections are replies rather than
+// RPC errors so that the reason reaches the coordinator intact.
+type PrepareReply struct {
+	Vote   bool
+	Reason *RejectReason
+}
+
+// CommitIndex identifies the last transaction a node committed. Commit
+// sequence numbers follow the same total order on every node, so comparing
+// indexes reveals replicas that lag behind (lower Seq) or diverged (same Seq,
+// different LastTxID).
+type CommitIndex struct {
+	NodeID    int       `json:"node_id"`
+	Seq       uint64    `json:"seq"`
+	LastTxID  uuid.UUID `json:"last_tx_id"`
+	Watermark uint64    `json:"watermark"`
+}
+
+// SubmitArgs asks a node to coordinate a transaction on behalf of a client.
+type SubmitArgs struct {
+	Command []byte
+	// Expected, when set, conditions the transaction like SubmitIf.
+	Expected []byte
+}
+
+// SubmitReply is the outcome of a transaction submitted over RPC. Failures
+// are part of the reply rather than RPC errors so the client still learns
+// the txID.
+type SubmitReply struct {
+	TxID      uuid.UUID
+	Committed bool
+	Error     string
+	Reason    *RejectReason
 }
 
 type NodeRPC interface {
 	Abort(args RequestArgs, reply *bool) error
-	Prepare(args RequestArgs, reply *bool) error
+	Prepare(args RequestArgs, reply *PrepareReply) error
 	Commit(args RequestArgs, reply *bool) error
 	GetStatus(txID uuid.UUID, reply *store.TransactionState) error
+	GetCommitIndex(senderID int, reply *CommitIndex) error
+	GetDigest(senderID int, reply *Digest) error
+	FetchState(after uint64, reply *StateTransfer) error
+	FetchSnapshot(args SnapshotChunkArgs, reply *SnapshotChunk) error
+	Submit(args SubmitArgs, reply *SubmitReply) error
 }
 
 type nodeRPC struct {
@@ -28,8 +84,45 @@ func (n *nodeRPC) GetStatus(txID uuid.UUID, reply *store.TransactionState) error
 	return err
 }
 
+func (n *nodeRPC) GetCommitIndex(senderID int, reply *CommitIndex) error {
+	*reply = n.parent.CommitIndex()
+	return nil
+}
+
+func (n *nodeRPC) GetDigest(senderID int, reply *Digest) error {
+	digest, err := n.parent.digest()
+	*reply = digest
+	return err
+}
+
+func (n *nodeRPC) FetchSnapshot(args SnapshotChunkArgs, reply *SnapshotChunk) error {
+	chunk, err := n.parent.snapshotChunk(args)
+	*reply = chunk
+	return err
+}
+
+func (n *nodeRPC) FetchState(after uint64, reply *StateTransfer) error {
+	transfer, err := n.parent.stateTransfer(after)
+	*reply = transfer
+	return err
+}
+
+func (n *nodeRPC) Submit(args SubmitArgs, reply *SubmitReply) error {
+	txID, err := n.parent.SubmitIf(args.Expected, args.Command)
+	reply.TxID = txID
+	if err != nil {
+		reply.Error = err.Error()
+		errors.As(err, &reply.Reason)
+		return nil
+	}
+	reply.Committed = true
+	return nil
+}
+
 func (n *nodeRPC) Abort(args RequestArgs, reply *bool) error {
-	err := n.parent.abort(args.TxID, args.SenderID)
+	n.parent.advanceWatermark(args.Watermark)
+	defer n.parent.traceTransaction(args.TxID, args.Trace)()
+	err := n.parent.abort(args.TxID, args.SenderID, args.Participants)
 
 	if err != nil {
 		*reply = false
@@ -40,20 +133,32 @@ func (n *nodeRPC) Abort(args RequestArgs, reply *bool) error {
 	return err
 }
 
-func (n *nodeRPC) Prepare(args RequestArgs, reply *bool) error {
-	err := n.parent.prepare(args.TxID, args.Value, args.SenderID)
+func (n *nodeRPC) Prepare(args RequestArgs, reply *PrepareReply) error {
+	n.parent.advanceWatermark(args.Watermark)
+	defer n.parent.traceTransaction(args.TxID, args.Trace)()
+
+	err := n.parent.checkStale(args.BaseSeq)
+	if err == nil {
+		err = n.parent.prepare(args.TxID, args.Command, args.Expected, args.SenderID, args.Participants)
+	}
 
 	if err != nil {
-		*reply = false
+		var reason *RejectReason
+		if !errors.As(err, &reason) {
+			reason = &RejectReason{Code: REJECT_VALIDATION_FAILED, Message: err.Error()}
+		}
+		*reply = PrepareReply{Vote: false, Reason: reason}
 	} else {
-		*reply = true
+		*reply = PrepareReply{Vote: true}
 	}
 
-	return err
+	return nil
 }
 
 func (n *nodeRPC) Commit(args RequestArgs, reply *bool) error {
-	err := n.parent.commit(args.TxID, args.Value, args.SenderID)
+	n.parent.advanceWatermark(args.Watermark)
+	defer n.parent.traceTransaction(args.TxID, args.Trace)()
+	err := n.parent.commit(args.TxID, args.Command, args.SenderID, args.Participants)
 
 	if err != nil {
 		*reply = false
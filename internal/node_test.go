@@ -1,12 +1,31 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
 )
 
 // cleanLogs removes the log directory to ensure a fresh start
@@ -96,7 +115,7 @@ func TestTwoPhaseCommit_AbortOnPrepareFailure(t *testing.T) {
 	// This forces the Prepare phase to fail on the participant.
 	partImpl := participant.(*node)
 	fakeTxID := uuid.New()
-	partImpl.volatileStore.Prepare(fakeTxID, 999)
+	partImpl.volatileStore.Prepare(fakeTxID, store.CounterSet(999))
 
 	t.Log("Participant manually locked. Initiating transaction...")
 	err := coordinator.Transaction(50)
@@ -230,3 +249,1698 @@ func TestSequentialTransactions(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeRecovery_ResolvesInDoubtWithCoordinator(t *testing.T) {
+	cleanLogs()
+	// Use IDs 60, 61
+	nodesConfig := generateNodes(60, 2)
+	coordinator, err := NewNode(60, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to create coordinator: %v", err)
+	}
+	defer teardown([]Node{coordinator})
+
+	// SIMULATION: the coordinator decided COMMIT, but the participant crashed
+	// right after persisting its PREPARED record.
+	txID := uuid.New()
+	participants := []int{60, 61}
+	coordImpl := coordinator.(*node)
+	if err := coordImpl.stableStore.WriteCommited(txID, store.CounterSet(7), 1, 60, participants); err != nil {
+		t.Fatalf("Failed to write coordinator decision: %v", err)
+	}
+
+	participantWAL, err := store.NewStableStore(DefaultDataDir, 61)
+	if err != nil {
+		t.Fatalf("Failed to open participant WAL: %v", err)
+	}
+	if err := participantWAL.WritePrepared(txID, store.CounterSet(7), 60, participants); err != nil {
+		t.Fatalf("Failed to write prepared record: %v", err)
+	}
+	participantWAL.Close()
+
+	participant, err := NewNode(61, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to restart participant: %v", err)
+	}
+	defer participant.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for participant.State() != 7 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if participant.State() != 7 {
+		t.Fatalf("In-doubt transaction not resolved with its coordinator. Want 7, Got %d", participant.State())
+	}
+}
+
+func TestNodeRecovery_ResolvesEveryInDoubtTransaction(t *testing.T) {
+	cleanLogs()
+	// Use IDs 70, 71
+	nodesConfig := generateNodes(70, 2)
+	coordinator, err := NewNode(70, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to create coordinator: %v", err)
+	}
+	defer teardown([]Node{coordinator})
+
+	// SIMULATION: the participant holds two PREPARED records without an
+	// outcome. The coordinator committed the older one and never decided
+	// the newer one (presumed abort).
+	committedTx, abortedTx := uuid.New(), uuid.New()
+	participants := []int{70, 71}
+	coordImpl := coordinator.(*node)
+	if err := coordImpl.stableStore.WriteCommited(committedTx, store.CounterSet(5), 1, 70, participants); err != nil {
+		t.Fatalf("Failed to write coordinator decision: %v", err)
+	}
+
+	participantWAL, err := store.NewStableStore(DefaultDataDir, 71)
+	if err != nil {
+		t.Fatalf("Failed to open participant WAL: %v", err)
+	}
+	participantWAL.WritePrepared(committedTx, store.CounterSet(5), 70, participants)
+	participantWAL.WritePrepared(abortedTx, store.CounterSet(9), 70, participants)
+	participantWAL.Close()
+
+	participant, err := NewNode(71, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to restart participant: %v", err)
+	}
+	defer participant.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for participant.State() != 5 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if participant.State() != 5 {
+		t.Fatalf("Older in-doubt transaction was dropped. Want 5, Got %d", participant.State())
+	}
+
+	// Both locks must have been released once each transaction was resolved.
+	time.Sleep(100 * time.Millisecond)
+	if err := participant.Transaction(1); err != nil {
+		t.Fatalf("Participant still locked after recovery: %v", err)
+	}
+	if status, _ := participant.(*node).getStatus(abortedTx); status != store.TRANSACTION_ABORTED {
+		t.Errorf("Undecided transaction should be aborted, got status %d", status)
+	}
+}
+
+func TestNodeRecovery_StableStoreBackends(t *testing.T) {
+	disk := store.NewMemoryDisk()
+	backends := map[string]func(id int) (store.StableStore, error){
+		"bolt": func(id int) (store.StableStore, error) {
+			return store.NewBoltStore(DefaultDataDir, id)
+		},
+		"memory": func(int) (store.StableStore, error) {
+			return store.NewMemoryStore(disk), nil
+		},
+	}
+
+	startID := 80
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			cleanLogs()
+			nodesConfig := generateNodes(startID, 2)
+			coordinatorID, victimID := startID, startID+1
+			startID += 2
+
+			coordinator, err := NewNode(coordinatorID, nodesConfig)
+			if err != nil {
+				t.Fatalf("Failed to create coordinator: %v", err)
+			}
+			defer teardown([]Node{coordinator})
+
+			victimStore, err := open(victimID)
+			if err != nil {
+				t.Fatalf("Failed to open %s store: %v", name, err)
+			}
+			victim, err := NewNode(victimID, nodesConfig, WithStableStore(victimStore))
+			if err != nil {
+				t.Fatalf("Failed to create node: %v", err)
+			}
+
+			if err := coordinator.Transaction(42); err != nil {
+				victim.Close()
+				t.Fatalf("Transaction failed: %v", err)
+			}
+
+			disk.Crash()
+			victim.Close()
+
+			recoveredStore, err := open(victimID)
+			if err != nil {
+				t.Fatalf("Failed to reopen %s store: %v", name, err)
+			}
+			recovered, err := NewNode(victimID, nodesConfig, WithStableStore(recoveredStore))
+			if err != nil {
+				t.Fatalf("Failed to restart node: %v", err)
+			}
+			defer recovered.Close()
+
+			if recovered.State() != 42 {
+				t.Errorf("Recovery failed. Want 42, Got %d", recovered.State())
+			}
+		})
+	}
+}
+
+// journal is a minimal application state machine: an append-only list of
+// non-empty entries.
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) Validate(cmd []byte) error {
+	if len(cmd) == 0 {
+		return errors.New("empty journal entry")
+	}
+	return nil
+}
+
+func (j *journal) Apply(cmd []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, string(cmd))
+	return nil
+}
+
+func (j *journal) Snapshot() ([]byte, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return []byte(strings.Join(j.entries, "\n")), nil
+}
+
+func (j *journal) Restore(snapshot []byte) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = nil
+	if len(snapshot) > 0 {
+		j.entries = strings.Split(string(snapshot), "\n")
+	}
+	return nil
+}
+
+func (j *journal) String() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return strings.Join(j.entries, ",")
+}
+
+func TestStateMachine_CustomMachine(t *testing.T) {
+	cleanLogs()
+	// Use IDs 90, 91
+	nodesConfig := generateNodes(90, 2)
+	disk := store.NewMemoryDisk()
+
+	coordinator, err := NewNode(90, nodesConfig, WithStateMachine(&journal{}))
+	if err != nil {
+		t.Fatalf("Failed to create coordinator: %v", err)
+	}
+	defer teardown([]Node{coordinator})
+
+	participant, err := NewNode(91, nodesConfig, WithStateMachine(&journal{}), WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to create participant: %v", err)
+	}
+
+	for _, cmd := range []string{"open", "deposit"} {
+		if _, err := coordinator.Submit([]byte(cmd)); err != nil {
+			participant.Close()
+			t.Fatalf("Submit %q failed: %v", cmd, err)
+		}
+	}
+	if _, err := coordinator.Submit(nil); err == nil {
+		t.Error("Expected invalid command to be rejected during prepare")
+	}
+	if err := coordinator.Transaction(1); err == nil {
+		t.Error("Expected Transaction to require the Counter state machine")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	participant.Close()
+
+	recovered, err := NewNode(91, nodesConfig, WithStateMachine(&journal{}), WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to restart participant: %v", err)
+	}
+	defer recovered.Close()
+
+	for _, n := range []Node{coordinator, recovered} {
+		if got := n.StateMachine().(*journal).String(); got != "open,deposit" {
+			t.Errorf("Node %d journal mismatch. Want open,deposit, Got %s", n.(*node).id, got)
+		}
+	}
+}
+
+func TestValidationHook_RejectReasonReachesCaller(t *testing.T) {
+	cleanLogs()
+	// Use IDs 100, 101, 102
+	nodesConfig := generateNodes(100, 3)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	coordinator, participant := nodes[0], nodes[1]
+	participant.RegisterValidator(func(txID uuid.UUID, cmd []byte, sm store.StateMachine) error {
+		balance, err := sm.(*store.Counter).Preview(cmd)
+		if err != nil {
+			return err
+		}
+		if balance < 0 {
+			return &RejectReason{Code: "negative_balance", Message: "balance must not go negative"}
+		}
+		return nil
+	})
+
+	err := coordinator.Transaction(-5)
+	if err == nil {
+		t.Fatal("Expected transaction to be rejected by the validation hook")
+	}
+
+	var reason *RejectReason
+	if !errors.As(err, &reason) {
+		t.Fatalf("Expected a structured reject reason, got %v", err)
+	}
+	if reason.NodeID != participant.(*node).id || reason.Code != "negative_balance" {
+		t.Errorf("Unexpected reject reason: %+v", reason)
+	}
+
+	// The rejected transaction must have released every lock.
+	if err := coordinator.Transaction(5); err != nil {
+		t.Fatalf("Follow-up transaction failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, n := range nodes {
+		if n.State() != 5 {
+			t.Errorf("Node %d state mismatch. Want 5, Got %d", n.(*node).id, n.State())
+		}
+	}
+}
+
+func TestValidationHook_RetransmittedPrepareKeepsItsVote(t *testing.T) {
+	cleanLogs()
+	// Use IDs 300, 301
+	nodesConfig := generateNodes(300, 2)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	p := nodes[1].(*node)
+	txID := uuid.New()
+	if err := p.prepare(txID, store.CounterAdd(1), nil, 300, []int{300, 301}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	// SIMULATION: the validator changed its mind after the participant
+	// voted yes, and the coordinator retransmits its prepare.
+	p.RegisterValidator(func(txID uuid.UUID, cmd []byte, sm store.StateMachine) error {
+		return errors.New("rejected")
+	})
+	if err := p.prepare(txID, store.CounterAdd(1), nil, 300, []int{300, 301}); err != nil {
+		t.Fatalf("Expected the retransmitted prepare to get the same vote, got %v", err)
+	}
+
+	if holders := p.volatileStore.LockHolders(); len(holders) != 1 || holders[0] != txID {
+		t.Errorf("Expected %s to keep the lock, got %v", txID, holders)
+	}
+	if !p.isPending(txID) {
+		t.Errorf("Expected %s to stay prepared", txID)
+	}
+}
+
+func TestCounterOperations_AppliedToEachNodeState(t *testing.T) {
+	cleanLogs()
+	// Use IDs 110, 111
+	nodesConfig := generateNodes(110, 2)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	coordinator, participant := nodes[0], nodes[1]
+
+	// SIMULATION: the participant's register diverged from the coordinator's.
+	participant.StateMachine().Apply(store.CounterSet(3))
+
+	if err := coordinator.Transaction(2); err != nil {
+		t.Fatalf("Add transaction failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Deltas are applied to each node's own state instead of overwriting it.
+	if coordinator.State() != 2 || participant.State() != 5 {
+		t.Fatalf("Add not applied per node. Want 2/5, Got %d/%d", coordinator.State(), participant.State())
+	}
+
+	// A compare-and-set built from the coordinator's view detects the divergence.
+	_, err := coordinator.Submit(store.CounterCompareAndSet(2, 10))
+	var reason *RejectReason
+	if !errors.As(err, &reason) || reason.NodeID != participant.(*node).id {
+		t.Fatalf("Expected the diverged participant to reject the compare-and-set, got %v", err)
+	}
+	if coordinator.State() != 2 || participant.State() != 5 {
+		t.Errorf("Rejected compare-and-set altered state: %d/%d", coordinator.State(), participant.State())
+	}
+
+	if _, err := coordinator.Submit(store.CounterSet(7)); err != nil {
+		t.Fatalf("Set transaction failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if coordinator.State() != 7 || participant.State() != 7 {
+		t.Errorf("Set not applied. Want 7/7, Got %d/%d", coordinator.State(), participant.State())
+	}
+}
+
+func TestConditionalTransaction_PreconditionFailed(t *testing.T) {
+	cleanLogs()
+	// Use IDs 120, 121
+	nodesConfig := generateNodes(120, 2)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	coordinator, participant := nodes[0], nodes[1]
+
+	if err := coordinator.TransactionIf(0, 5); err != nil {
+		t.Fatalf("Conditional transaction on unchanged state failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Stale expectation, rejected by the coordinator itself.
+	err := coordinator.TransactionIf(0, 1)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Expected ErrPreconditionFailed from the coordinator, got %v", err)
+	}
+
+	// SIMULATION: only the participant moved on, so only it rejects.
+	participant.StateMachine().Apply(store.CounterSet(9))
+	err = coordinator.TransactionIf(5, 1)
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Expected ErrPreconditionFailed from the participant, got %v", err)
+	}
+	var reason *RejectReason
+	if !errors.As(err, &reason) || reason.NodeID != participant.(*node).id {
+		t.Errorf("Expected the participant to report the failed precondition, got %v", err)
+	}
+
+	if coordinator.State() != 5 || participant.State() != 9 {
+		t.Errorf("Rejected conditional transactions altered state: %d/%d", coordinator.State(), participant.State())
+	}
+}
+
+func TestRead_ResolvesPendingTransactionWithCoordinator(t *testing.T) {
+	cleanLogs()
+	// Use IDs 130, 131
+	nodesConfig := generateNodes(130, 2)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	coordinator, participant := nodes[0], nodes[1]
+	coordID := coordinator.(*node).id
+	participants := []int{130, 131}
+
+	// SIMULATION: the coordinator decided COMMIT but the participant, which
+	// voted yes, has not received the Commit yet.
+	txID := uuid.New()
+	if err := participant.prepare(txID, store.CounterAdd(4), nil, coordID, participants); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if err := coordinator.(*node).stableStore.WriteCommited(txID, store.CounterAdd(4), 1, coordID, participants); err != nil {
+		t.Fatalf("Failed to write coordinator decision: %v", err)
+	}
+
+	if participant.State() != 0 {
+		t.Fatalf("Participant should still hold stale state, got %d", participant.State())
+	}
+
+	snapshot, err := participant.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if value, _ := store.DecodeCounterState(snapshot); value != 4 {
+		t.Errorf("Read returned torn state. Want 4, Got %d", value)
+	}
+
+	// Without anyone to ask, a pending transaction makes the read fail.
+	otherTx := uuid.New()
+	if err := participant.prepare(otherTx, store.CounterAdd(1), nil, coordID, participants); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	coordinator.Close()
+
+	if _, err := participant.Read(); !errors.Is(err, ErrInDoubt) {
+		t.Errorf("Expected ErrInDoubt with the coordinator down, got %v", err)
+	}
+}
+
+func TestVersionedState_HistoricalReads(t *testing.T) {
+	cleanLogs()
+	// Use IDs 140, 141
+	nodesConfig := generateNodes(140, 2)
+	disk := store.NewMemoryDisk()
+
+	coordinator, err := NewNode(140, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to create coordinator: %v", err)
+	}
+	defer teardown([]Node{coordinator})
+
+	participant, err := NewNode(141, nodesConfig, WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to create participant: %v", err)
+	}
+
+	for _, delta := range []int{1, 2, 3} {
+		if err := coordinator.Transaction(delta); err != nil {
+			participant.Close()
+			t.Fatalf("Transaction +%d failed: %v", delta, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	readAt := func(n Node, seq uint64) (int, error) {
+		snapshot, err := n.ReadAt(seq)
+		if err != nil {
+			return 0, err
+		}
+		return store.DecodeCounterState(snapshot)
+	}
+
+	for seq, want := range map[uint64]int{0: 0, 1: 1, 2: 3, 3: 6} {
+		if got, err := readAt(participant, seq); err != nil || got != want {
+			t.Errorf("ReadAt(%d) = %d, %v. Want %d", seq, got, err, want)
+		}
+	}
+	if _, err := readAt(participant, 4); !errors.Is(err, store.ErrVersionNotFound) {
+		t.Errorf("Expected ErrVersionNotFound for a future version, got %v", err)
+	}
+
+	// Restarting snapshots the node, which garbage collects old versions.
+	participant.Close()
+	participant, err = NewNode(141, nodesConfig, WithStableStore(store.NewMemoryStore(disk)), WithVersionRetention(2))
+	if err != nil {
+		t.Fatalf("Failed to restart participant: %v", err)
+	}
+	defer participant.Close()
+
+	if got, err := readAt(participant, 3); err != nil || got != 6 {
+		t.Errorf("ReadAt(3) after restart = %d, %v. Want 6", got, err)
+	}
+	if _, err := readAt(participant, 1); !errors.Is(err, store.ErrVersionPruned) {
+		t.Errorf("Expected ErrVersionPruned for a collected version, got %v", err)
+	}
+	if versions := participant.Versions(); len(versions) != 2 {
+		t.Errorf("Expected 2 retained versions, got %d", len(versions))
+	}
+}
+
+func TestCommitIndex_TotalOrderSurvivesRestart(t *testing.T) {
+	cleanLogs()
+	// Use IDs 150, 151, 152
+	nodesConfig := generateNodes(150, 3)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	// Every node takes a turn as coordinator.
+	for _, n := range nodes {
+		if err := n.Transaction(1); err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	want := nodes[0].CommitIndex()
+	if want.Seq != 3 {
+		t.Fatalf("Expected commit sequence 3, got %d", want.Seq)
+	}
+
+	// Peers report the same position through the RPC.
+	coordinator := nodes[0].(*node)
+	for _, r := range Broadcast[CommitIndex](coordinator.peers, "Node.GetCommitIndex", coordinator.id) {
+		if r.Err != nil || r.Value.Seq != want.Seq || r.Value.LastTxID != want.LastTxID {
+			t.Errorf("Node %d diverged: %+v (err %v), want seq %d tx %s", r.PeerID, r.Value, r.Err, want.Seq, want.LastTxID)
+		}
+	}
+
+	// The position is recovered first from the WAL, then from the snapshot
+	// the first restart took.
+	victim := nodes[2].(*node)
+	for restart := 1; restart <= 2; restart++ {
+		victim.Close()
+		restarted, err := NewNode(victim.id, nodesConfig)
+		if err != nil {
+			t.Fatalf("Failed to restart node: %v", err)
+		}
+		victim = restarted.(*node)
+		nodes[2] = victim
+
+		if got := victim.CommitIndex(); got.Seq != want.Seq || got.LastTxID != want.LastTxID {
+			t.Errorf("Restart %d lost the commit index: %+v, want seq %d tx %s", restart, got, want.Seq, want.LastTxID)
+		}
+	}
+}
+
+func TestAntiEntropy_RepairsMissingCommitsAndReportsDivergence(t *testing.T) {
+	cleanLogs()
+	// Use IDs 160, 161, 162. Nodes 160 and 161 commit without knowing 162,
+	// which therefore misses every commit.
+	nodesConfig := generateNodes(160, 3)
+	nodes := createCluster(t, generateNodes(160, 2))
+	defer teardown(nodes)
+
+	n, err := NewNode(162, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	nodes = append(nodes, n)
+	lagging := n.(*node)
+
+	for i := 1; i <= 3; i++ {
+		if err := nodes[0].Transaction(i); err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	reports, err := lagging.CheckConsistency()
+	if err != nil {
+		t.Fatalf("CheckConsistency failed: %v", err)
+	}
+	for _, r := range reports {
+		if r.Status != REPLICA_AHEAD {
+			t.Errorf("Expected node %d to be ahead, got %s", r.PeerID, r.Status)
+		}
+	}
+
+	if err := lagging.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	want := nodes[0].CommitIndex()
+	if got := lagging.CommitIndex(); lagging.State() != 6 || got.Seq != want.Seq || got.LastTxID != want.LastTxID {
+		t.Errorf("Repair did not catch up: state %d, index %+v, want %+v", lagging.State(), got, want)
+	}
+
+	reports, _ = lagging.CheckConsistency()
+	for _, r := range reports {
+		if r.Status != REPLICA_IN_SYNC {
+			t.Errorf("Expected node %d in sync after repair, got %s", r.PeerID, r.Status)
+		}
+	}
+
+	// The replayed commits were persisted.
+	lagging.Close()
+	if n, err = NewNode(162, nodesConfig); err != nil {
+		t.Fatalf("Failed to restart node: %v", err)
+	}
+	nodes[2] = n
+	lagging = n.(*node)
+	if lagging.State() != 6 {
+		t.Errorf("Expected state 6 after restart, got %d", lagging.State())
+	}
+
+	// A different commit at the same position cannot be repaired.
+	if err := nodes[0].Transaction(1); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	rogue := store.Entry{TxID: uuid.New(), Seq: 4, Command: store.CounterAdd(1)}
+	if err := lagging.volatileStore.Replay(rogue); err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+
+	if err := lagging.Repair(); !errors.Is(err, ErrDiverged) {
+		t.Errorf("Expected ErrDiverged, got %v", err)
+	}
+}
+
+func TestCatchUp_ReturningNodeReceivesSnapshot(t *testing.T) {
+	cleanLogs()
+	// Use IDs 170, 171, 172. Nodes 170 and 171 start from a snapshot whose
+	// commits were compacted away, so only a snapshot can bring 172 up to
+	// date.
+	nodesConfig := generateNodes(170, 3)
+	compacted := store.SnapshotData{
+		State:        store.EncodeCounterState(42),
+		Seq:          2,
+		CommittedLog: map[uuid.UUID]uint64{uuid.New(): 1, uuid.New(): 2},
+	}
+
+	var nodes []Node
+	defer func() { teardown(nodes) }()
+	for id := range generateNodes(170, 2) {
+		disk := store.NewMemoryDisk()
+		if err := store.NewMemoryStore(disk).SaveSnapshot(compacted); err != nil {
+			t.Fatalf("SaveSnapshot failed: %v", err)
+		}
+		n, err := NewNode(id, generateNodes(170, 2), WithStableStore(store.NewMemoryStore(disk)))
+		if err != nil {
+			t.Fatalf("Failed to create node %d: %v", id, err)
+		}
+		nodes = append(nodes, n)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	if err := nodes[0].Transaction(1); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// The returning node catches up on startup.
+	disk := store.NewMemoryDisk()
+	n, err := NewNode(172, nodesConfig, WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	nodes = append(nodes, n)
+
+	want := nodes[0].CommitIndex()
+	if got := n.CommitIndex(); n.State() != 43 || got.Seq != want.Seq || got.LastTxID != want.LastTxID {
+		t.Errorf("Node did not catch up: state %d, index %+v, want %+v", n.State(), got, want)
+	}
+
+	reports, err := n.CheckConsistency()
+	if err != nil {
+		t.Fatalf("CheckConsistency failed: %v", err)
+	}
+	for _, r := range reports {
+		if r.Status != REPLICA_IN_SYNC {
+			t.Errorf("Expected node %d in sync, got %s", r.PeerID, r.Status)
+		}
+	}
+
+	// The transferred state was persisted: the node recovers it from its
+	// own disk, alone, after a crash.
+	n.Close()
+	disk.Crash()
+	alone, err := NewNode(172, generateNodes(172, 1), WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to restart node: %v", err)
+	}
+	nodes = append(nodes, alone)
+	if got := alone.CommitIndex(); alone.State() != 43 || got.Seq != want.Seq {
+		t.Errorf("Expected state 43 at seq %d after restart, got %d at %+v", want.Seq, alone.State(), got)
+	}
+}
+
+func TestWatermark_PrunesHistoryAndRejectsDuplicates(t *testing.T) {
+	cleanLogs()
+	// Use IDs 180, 181, 182
+	nodesConfig := generateNodes(180, 3)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	coordinator := nodes[0].(*node)
+	for i := 0; i < 5; i++ {
+		if err := coordinator.Transaction(1); err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	first := coordinator.Versions()[1]
+
+	// The coordinator saw every node acknowledge the last commit, the peers
+	// learned the watermark with the previous one.
+	for i, n := range nodes {
+		want := uint64(4)
+		if i == 0 {
+			want = 5
+		}
+		if got := n.CommitIndex().Watermark; got != want {
+			t.Errorf("Node %d: expected watermark %d, got %d", n.CommitIndex().NodeID, want, got)
+		}
+		data, err := n.(*node).volatileStore.Checkpoint()
+		if err != nil {
+			t.Fatalf("Checkpoint failed: %v", err)
+		}
+		// The last commit is kept even below the watermark.
+		if len(data.CommittedLog) > 2 || len(data.Commits) > 1 {
+			t.Errorf("Node %d: history not pruned, %d committed and %d commits kept",
+				n.CommitIndex().NodeID, len(data.CommittedLog), len(data.Commits))
+		}
+	}
+
+	// A duplicate of the first transaction is recognised although its
+	// outcome was pruned.
+	participant := nodes[1].(*node)
+	duplicate := RequestArgs{
+		TxID:         first.TxID,
+		Command:      store.CounterAdd(1),
+		SenderID:     coordinator.id,
+		Participants: coordinator.participantIDs(),
+	}
+	var vote PrepareReply
+	if err := coordinator.peer(participant.id).Call("Node.Prepare", duplicate, &vote); err != nil {
+		t.Fatalf("Prepare call failed: %v", err)
+	}
+	if vote.Vote || vote.Reason == nil || vote.Reason.Code != REJECT_ALREADY_COMMITTED {
+		t.Errorf("Expected the duplicate prepare to be rejected as already committed, got %+v", vote)
+	}
+
+	// Its commit is refused rather than acknowledged, so it cannot count
+	// towards the watermark.
+	var ack bool
+	if err := coordinator.peer(participant.id).Call("Node.Commit", duplicate, &ack); err == nil || ack {
+		t.Errorf("Expected the duplicate commit to be refused, got ack %v, %v", ack, err)
+	}
+	if participant.State() != 5 {
+		t.Errorf("Duplicate commit was applied again: state %d", participant.State())
+	}
+
+	// A restarted node keeps its history since the last snapshot and learns
+	// the watermark back from the next transaction.
+	participant.Close()
+	restarted, err := NewNode(participant.id, nodesConfig)
+	if err != nil {
+		t.Fatalf("Failed to restart node: %v", err)
+	}
+	nodes[1] = restarted
+
+	if err := restarted.Transaction(1); err != nil {
+		t.Fatalf("Transaction after restart failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, n := range nodes {
+		if n.State() != 6 {
+			t.Errorf("Node %d: expected state 6, got %d", n.CommitIndex().NodeID, n.State())
+		}
+	}
+	if got := restarted.CommitIndex().Watermark; got != 6 {
+		t.Errorf("Expected watermark 6 after restart, got %d", got)
+	}
+}
+
+func TestSnapshotPolicy_CompactsWALInBackground(t *testing.T) {
+	cleanLogs()
+	// Use IDs 190, 191, 192
+	nodesConfig := generateNodes(190, 3)
+	disks := make(map[int]*store.MemoryDisk)
+	policy := SnapshotPolicy{Records: 6}
+
+	var nodes []Node
+	defer func() { teardown(nodes) }()
+	for id := range nodesConfig {
+		disks[id] = store.NewMemoryDisk()
+		n, err := NewNode(id, nodesConfig, WithStableStore(store.NewMemoryStore(disks[id])), WithSnapshotPolicy(policy))
+		if err != nil {
+			t.Fatalf("Failed to create node %d: %v", id, err)
+		}
+		nodes = append(nodes, n)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Snapshots taken by hand while transactions run must not lose any of
+	// their records.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if _, err := nodes[1].TakeSnapshot(); err != nil {
+					t.Errorf("TakeSnapshot failed: %v", err)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if err := nodes[0].Transaction(1); err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// Every transaction writes two records on each node, so the policy
+	// kicks in without any help on the other nodes.
+	deadline := time.Now().Add(2 * time.Second)
+	for _, n := range nodes {
+		for n.LastSnapshot().Seq < 3 && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+		}
+		info := n.LastSnapshot()
+		if info.Seq < 3 || info.LSN < 6 {
+			t.Errorf("Node %d: expected a background snapshot, last one is %+v", n.CommitIndex().NodeID, info)
+		}
+
+		stats, err := n.(*node).stableStore.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		if stats.Records >= 20 {
+			t.Errorf("Node %d: WAL was not compacted, %d records", n.CommitIndex().NodeID, stats.Records)
+		}
+	}
+
+	// Each node recovers the full state from its snapshot and what is left
+	// of its WAL, alone so that nothing can be fetched from a peer.
+	for i, n := range nodes {
+		id := n.CommitIndex().NodeID
+		n.Close()
+		disks[id].Crash()
+
+		restarted, err := NewNode(id, generateNodes(id, 1), WithStableStore(store.NewMemoryStore(disks[id])))
+		if err != nil {
+			t.Fatalf("Failed to restart node %d: %v", id, err)
+		}
+		nodes[i] = restarted
+		if restarted.State() != 10 || restarted.CommitIndex().Seq != 10 {
+			t.Errorf("Node %d: expected state 10 at seq 10 after restart, got %d at %d", id, restarted.State(), restarted.CommitIndex().Seq)
+		}
+	}
+}
+
+func TestDataDir_SecondStoreFailsFast(t *testing.T) {
+	cleanLogs()
+	// Use ID 200
+	dir := t.TempDir()
+	nodesConfig := generateNodes(200, 1)
+
+	n, err := NewNode(200, nodesConfig, WithDataDir(dir))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Close()
+	if err := n.Transaction(3); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "node_200.wal")); err != nil {
+		t.Errorf("WAL not written to the data directory: %v", err)
+	}
+	if _, err := os.Stat(DefaultDataDir); !os.IsNotExist(err) {
+		t.Errorf("Node wrote outside its data directory: %v", err)
+	}
+
+	// A second node with the same directory fails before doing anything,
+	// for every backend taking the lock.
+	start := time.Now()
+	if _, err := NewNode(200, nodesConfig, WithDataDir(dir)); !errors.Is(err, store.ErrDataDirLocked) {
+		t.Errorf("Expected ErrDataDirLocked, got %v", err)
+	}
+	if _, err := store.NewStableStore(dir, 200); !errors.Is(err, store.ErrDataDirLocked) {
+		t.Errorf("Expected ErrDataDirLocked from the file WAL, got %v", err)
+	}
+	if _, err := store.NewBoltStore(dir, 200); !errors.Is(err, store.ErrDataDirLocked) {
+		t.Errorf("Expected ErrDataDirLocked from bbolt, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Locked directory took %v to be reported", elapsed)
+	}
+
+	// Closing the node releases the directory.
+	n.Close()
+	restarted, err := NewNode(200, nodesConfig, WithDataDir(dir))
+	if err != nil {
+		t.Fatalf("Failed to restart node on its data directory: %v", err)
+	}
+	defer restarted.Close()
+	if restarted.State() != 3 {
+		t.Errorf("Expected state 3 after restart, got %d", restarted.State())
+	}
+}
+
+func TestEncryption_NodeRestartsWithItsKeys(t *testing.T) {
+	cleanLogs()
+	// Use ID 210
+	dir := t.TempDir()
+	nodesConfig := generateNodes(210, 1)
+	keys, err := store.NewFileKeyProvider(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+
+	n, err := NewNode(210, nodesConfig, WithDataDir(dir), WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer func() { n.Close() }()
+	if err := n.Transaction(5); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	if _, err := n.TakeSnapshot(); err != nil {
+		t.Fatalf("TakeSnapshot failed: %v", err)
+	}
+	if err := n.Transaction(1); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	n.Close()
+
+	// The node seals its snapshot and WAL, so it cannot start without the
+	// keys; sealing itself is covered by the store tests.
+	if _, err := NewNode(210, nodesConfig, WithDataDir(dir)); !errors.Is(err, store.ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted without a key, got %v", err)
+	}
+
+	n, err = NewNode(210, nodesConfig, WithDataDir(dir), WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("Failed to restart node with its keys: %v", err)
+	}
+	if n.State() != 6 {
+		t.Errorf("Expected state 6 after restart, got %d", n.State())
+	}
+}
+
+func TestNewNode_ListensOnConfiguredAddress(t *testing.T) {
+	cleanLogs()
+	// Use IDs 230-231, on ports outside the 3000+ID convention
+	nodesConfig := map[int]string{
+		230: "localhost:4230",
+		231: "localhost:4231",
+	}
+
+	coordinator, err := NewNode(230, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer coordinator.Close()
+
+	// The participant binds every interface but is dialed on its entry.
+	participant, err := NewNode(231, nodesConfig, WithListenAddress(":4231"), WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer participant.Close()
+
+	if err := coordinator.Transaction(6); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+	if state := participant.State(); state != 6 {
+		t.Errorf("Expected participant state 6, got %d", state)
+	}
+}
+
+func TestSubmitRPC_ReturnsTxIDAndOutcome(t *testing.T) {
+	cleanLogs()
+	// Use IDs 240-241
+	nodesConfig := generateNodes(240, 2)
+	nodes := createCluster(t, nodesConfig)
+	defer teardown(nodes)
+
+	// A client outside the cluster submits through plain net/rpc.
+	client, err := rpc.Dial("tcp", nodesConfig[241])
+	if err != nil {
+		t.Fatalf("Failed to dial node: %v", err)
+	}
+	defer client.Close()
+
+	var committed SubmitReply
+	if err := client.Call("Node.Submit", SubmitArgs{Command: store.CounterAdd(7)}, &committed); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if !committed.Committed || committed.TxID == uuid.Nil || committed.Error != "" {
+		t.Fatalf("Expected a committed transaction, got %+v", committed)
+	}
+	var status store.TransactionState
+	if err := client.Call("Node.GetStatus", committed.TxID, &status); err != nil || status != store.TRANSACTION_COMMITTED {
+		t.Errorf("Expected COMMITTED, got %v, %v", status, err)
+	}
+	for _, n := range nodes {
+		if state := n.State(); state != 7 {
+			t.Errorf("Expected state 7, got %d", state)
+		}
+	}
+
+	// A rejected transaction still reports its txID, with the reason.
+	var aborted SubmitReply
+	if err := client.Call("Node.Submit", SubmitArgs{Command: store.CounterCompareAndSet(3, 9)}, &aborted); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	if aborted.Committed || aborted.TxID == uuid.Nil || aborted.TxID == committed.TxID {
+		t.Fatalf("Expected an aborted transaction with its own txID, got %+v", aborted)
+	}
+	if aborted.Reason == nil || aborted.Reason.Code != REJECT_PRECONDITION_FAILED {
+		t.Errorf("Expected a precondition failure, got %+v (%s)", aborted.Reason, aborted.Error)
+	}
+	if err := client.Call("Node.GetStatus", aborted.TxID, &status); err != nil || status != store.TRANSACTION_ABORTED {
+		t.Errorf("Expected ABORTED, got %v, %v", status, err)
+	}
+}
+
+// writeTestCertificates writes a CA and a certificate it signed for
+// localhost to dir, as PEM files.
+func writeTestCertificates(t *testing.T, dir string) (certFile, keyFile, caFile string) {
+	t.Helper()
+
+	writePEM := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "2pc test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return writePEM("node.crt", "CERTIFICATE", der), writePEM("node.key", "EC PRIVATE KEY", keyDER), writePEM("ca.crt", "CERTIFICATE", caDER)
+}
+
+func TestClusterConfig_OptionsSnapshotInTheBackgroundByDefault(t *testing.T) {
+	c := &ClusterConfig{Nodes: []NodeConfig{{ID: 0, Address: "node0:3000"}}}
+	build := func() options {
+		t.Helper()
+		opts, err := c.Options(0)
+		if err != nil {
+			t.Fatalf("Failed to build options: %v", err)
+		}
+		var o options
+		for _, opt := range opts {
+			opt(&o)
+		}
+		return o
+	}
+
+	o := build()
+	if o.snapshotPolicy != DefaultSnapshotPolicy || o.antiEntropyInterval != DefaultAntiEntropyInterval {
+		t.Errorf("Expected the default snapshot policy and anti-entropy, got %+v and %v", o.snapshotPolicy, o.antiEntropyInterval)
+	}
+
+	off := Duration(0)
+	c.Snapshots, c.AntiEntropy = &SnapshotsConfig{}, &off
+	if o := build(); o.snapshotPolicy.enabled() || o.antiEntropyInterval != 0 {
+		t.Errorf("Expected background snapshots and anti-entropy off, got %+v and %v", o.snapshotPolicy, o.antiEntropyInterval)
+	}
+}
+
+func TestClusterConfig_RunsNodesOverMutualTLS(t *testing.T) {
+	cleanLogs()
+	// Use IDs 250-251
+	dir := t.TempDir()
+	certFile, keyFile, caFile := writeTestCertificates(t, dir)
+
+	c := &ClusterConfig{
+		DataDir:  dir,
+		Timeouts: TimeoutsConfig{RPC: Duration(2 * time.Second)},
+		TLS:      &TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile},
+		Nodes: []NodeConfig{
+			{ID: 250, Address: "localhost:3250"},
+			{ID: 251, Address: "localhost:3251"},
+		},
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	var nodes []Node
+	for _, id := range c.IDs() {
+		opts, err := c.Options(id)
+		if err != nil {
+			t.Fatalf("Failed to build options: %v", err)
+		}
+		n, err := NewNode(id, c.Addresses(), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		defer n.Close()
+		nodes = append(nodes, n)
+	}
+
+	if err := nodes[0].Transaction(8); err != nil {
+		t.Fatalf("Transaction over TLS failed: %v", err)
+	}
+	if state := nodes[1].State(); state != 8 {
+		t.Errorf("Expected state 8, got %d", state)
+	}
+
+	// A plain TCP client cannot talk to the nodes anymore.
+	if client, err := rpc.Dial("tcp", "localhost:3251"); err == nil {
+		var index CommitIndex
+		done := make(chan error, 1)
+		go func() { done <- client.Call("Node.GetCommitIndex", 0, &index) }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Error("Expected a plain TCP call to fail")
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("Plain TCP call hung instead of failing")
+		}
+		client.Close()
+	}
+}
+
+func TestAdmin_ServesStatusAndProbes(t *testing.T) {
+	cleanLogs()
+	// Use IDs 260-261
+	nodesConfig := generateNodes(260, 2)
+	coordinator, err := NewNode(260, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer coordinator.Close()
+	participant, err := NewNode(261, nodesConfig, WithAdmin("localhost:4261"), WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer participant.Close()
+
+	get := func(path string, v any) int {
+		t.Helper()
+		resp, err := http.Get("http://localhost:4261" + path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", path, err)
+		}
+		return resp.StatusCode
+	}
+
+	var probe map[string]any
+	if code := get("/healthz", &probe); code != http.StatusOK {
+		t.Errorf("Expected live node, got %d", code)
+	}
+	if code := get("/readyz", &probe); code != http.StatusOK {
+		t.Errorf("Expected ready node, got %d", code)
+	}
+
+	if err := coordinator.Transaction(5); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	// A transaction the participant voted yes for holds the lock and is in
+	// doubt until its outcome arrives.
+	txID := uuid.New()
+	p := participant.(*node)
+	if err := p.prepare(txID, store.CounterAdd(1), nil, 260, []int{260, 261}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+
+	var status NodeStatus
+	if code := get("/status", &status); code != http.StatusOK {
+		t.Fatalf("Expected status, got %d", code)
+	}
+	if status.NodeID != 261 || !status.Ready || status.Counter == nil || *status.Counter != 5 {
+		t.Errorf("Unexpected node status: %+v", status)
+	}
+	if status.CommitIndex.Seq != 1 || status.WAL.Records < 3 || status.WAL.Bytes == 0 {
+		t.Errorf("Unexpected commit index %+v or WAL stats %+v", status.CommitIndex, status.WAL)
+	}
+	if len(status.LockHolders) != 1 || status.LockHolders[0] != txID {
+		t.Errorf("Expected %s to hold the lock, got %v", txID, status.LockHolders)
+	}
+	if len(status.InDoubt) != 1 || status.InDoubt[0].TxID != txID || status.InDoubt[0].Coordinator != 260 {
+		t.Errorf("Expected %s in doubt, got %+v", txID, status.InDoubt)
+	}
+	// The participant only dialed the coordinator during catch-up.
+	if len(status.Peers) != 1 || status.Peers[0].ID != 260 || status.Peers[0].Address != nodesConfig[260] {
+		t.Errorf("Unexpected peers %+v", status.Peers)
+	}
+
+	if err := p.abort(txID, 260, []int{260, 261}); err != nil {
+		t.Fatalf("Abort failed: %v", err)
+	}
+
+	// Once the coordinator is gone, the participant sees it unreachable.
+	coordinator.Close()
+	p.CheckConsistency()
+	if status, err = participant.Status(); err != nil {
+		t.Fatalf("Status failed: %v", err)
+	}
+	if len(status.LockHolders) != 0 || len(status.InDoubt) != 0 {
+		t.Errorf("Expected no lock holder nor transaction in doubt, got %+v", status)
+	}
+	if peer := status.Peers[0]; peer.Connected || peer.LastError == "" {
+		t.Errorf("Expected the coordinator to be reported unreachable, got %+v", peer)
+	}
+
+	participant.Close()
+	if _, err := http.Get("http://localhost:4261/healthz"); err == nil {
+		t.Error("Expected the admin endpoint to stop with the node")
+	}
+}
+
+func TestMetrics_ExposesProtocolCountersAndLatencies(t *testing.T) {
+	cleanLogs()
+	// Use IDs 270-272
+	nodesConfig := generateNodes(270, 3)
+	coordinator, err := NewNode(270, nodesConfig, WithAdmin("localhost:4270"), WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer coordinator.Close()
+	participant, err := NewNode(271, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer participant.Close()
+	// Node 272 never starts, so every prepare sent to it fails.
+
+	// A transaction holding the participant's lock makes the next one
+	// conflict on it.
+	blocker := uuid.New()
+	if err := participant.(*node).prepare(blocker, store.CounterAdd(1), nil, 271, []int{271}); err != nil {
+		t.Fatalf("Prepare failed: %v", err)
+	}
+	if err := coordinator.Transaction(1); err == nil {
+		t.Fatal("Expected the transaction to abort")
+	}
+	participant.(*node).abort(blocker, 271, []int{271})
+
+	resp, err := http.Get("http://localhost:4270/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected the Prometheus text format, got %q", ct)
+	}
+
+	metrics := string(body)
+	for _, want := range []string{
+		"# TYPE twopc_transactions_started_total counter",
+		"twopc_transactions_started_total 1\n",
+		"twopc_transactions_committed_total 0\n",
+		// The first reason of the joined rejections is reported.
+		`twopc_transactions_aborted_total{reason="`,
+		`twopc_phase_duration_seconds_count{phase="prepare"} 1` + "\n",
+		`twopc_peer_rpc_errors_total{peer="272",method="Node.Prepare",kind="error"} 1` + "\n",
+		`twopc_wal_sync_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"twopc_lock_hold_seconds_count 1\n",
+		"# TYPE twopc_lock_hold_seconds histogram",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, `phase="commit"`) {
+		t.Error("Expected no commit phase for an aborted transaction")
+	}
+
+	// The participant counted the prepare it rejected on its busy lock.
+	var conflicts strings.Builder
+	participant.(*node).metrics.lockConflicts.write(&conflicts)
+	if !strings.Contains(conflicts.String(), "twopc_lock_conflicts_total 1\n") {
+		t.Errorf("Expected a lock conflict on the participant, got:\n%s", conflicts.String())
+	}
+}
+
+func TestTracing_JoinsCoordinatorAndParticipantSpansInOneTrace(t *testing.T) {
+	cleanLogs()
+	// Use IDs 280-281
+
+	// The coordinator exports to an OTLP collector, the participant to a
+	// stdout exporter.
+	var (
+		collectorMu sync.Mutex
+		collected   []SpanData
+	)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		collectorMu.Lock()
+		defer collectorMu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					collected = append(collected, SpanData{Name: s.Name, TraceID: s.TraceID, SpanID: s.SpanID, ParentSpanID: s.ParentSpanID, NodeID: 280})
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	var stdout bytes.Buffer
+	nodesConfig := generateNodes(280, 2)
+	coordinator, err := NewNode(280, nodesConfig, WithTracing(NewOTLPExporter(collector.URL)), WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	participant, err := NewNode(281, nodesConfig, WithTracing(NewStdoutExporter(&stdout)), WithDataDir(t.TempDir()))
+	if err != nil {
+		coordinator.Close()
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	if err := coordinator.Transaction(5); err != nil {
+		t.Fatalf("Transaction failed: %v", err)
+	}
+
+	// Closing the nodes flushes the spans they still hold.
+	coordinator.Close()
+	participant.Close()
+
+	collectorMu.Lock()
+	spans := collected
+	collectorMu.Unlock()
+	decoder := json.NewDecoder(&stdout)
+	for decoder.More() {
+		var s SpanData
+		if err := decoder.Decode(&s); err != nil {
+			t.Fatalf("Failed to decode span: %v", err)
+		}
+		spans = append(spans, s)
+	}
+
+	byName := make(map[string][]SpanData)
+	for _, s := range spans {
+		byName[s.Name] = append(byName[s.Name], s)
+	}
+	if len(byName["2pc.Transaction"]) != 1 {
+		t.Fatalf("Expected one transaction span, got %+v", spans)
+	}
+	root := byName["2pc.Transaction"][0]
+	if root.ParentSpanID != "" {
+		t.Errorf("Expected the transaction span to be a root, got parent %s", root.ParentSpanID)
+	}
+
+	for _, s := range spans {
+		if s.TraceID != root.TraceID {
+			t.Errorf("Expected span %s of node %d in trace %s, got %s", s.Name, s.NodeID, root.TraceID, s.TraceID)
+		}
+	}
+
+	// Both nodes prepared and committed as children of the transaction, and
+	// wrote their WAL records within those spans.
+	for _, phase := range []struct{ name, wal string }{
+		{"2pc.Prepare", "wal.WritePrepared"},
+		{"2pc.Commit", "wal.WriteCommitted"},
+	} {
+		nodes := make(map[int]bool)
+		for _, s := range byName[phase.name] {
+			if s.ParentSpanID != root.SpanID {
+				t.Errorf("Expected %s of node %d under the transaction span, got parent %s", phase.name, s.NodeID, s.ParentSpanID)
+			}
+			nodes[s.NodeID] = true
+
+			found := false
+			for _, w := range byName[phase.wal] {
+				found = found || w.ParentSpanID == s.SpanID
+			}
+			if !found {
+				t.Errorf("Expected a %s span under %s of node %d", phase.wal, phase.name, s.NodeID)
+			}
+		}
+		if !nodes[280] || !nodes[281] {
+			t.Errorf("Expected %s spans from both nodes, got %v", phase.name, nodes)
+		}
+	}
+}
+
+func TestNodeRecovery_SkipsCommitsAlreadyInSnapshot(t *testing.T) {
+	cleanLogs()
+	// Use IDs 290-291
+	nodesConfig := generateNodes(290, 2)
+	disk := store.NewMemoryDisk()
+	coordinator, err := NewNode(290, nodesConfig, WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	participant, err := NewNode(291, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer participant.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := coordinator.Transaction(1); err != nil {
+			t.Fatalf("Transaction failed: %v", err)
+		}
+	}
+	if got := coordinator.CommitIndex().Watermark; got != 3 {
+		t.Fatalf("Expected the history to be pruned up to 3, got watermark %d", got)
+	}
+
+	// The node crashes between saving a snapshot and compacting the WAL, so
+	// the commits the snapshot holds are still in the log.
+	n := coordinator.(*node)
+	data, err := n.volatileStore.Checkpoint()
+	if err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := n.stableStore.SaveSnapshot(*data); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	disk.Crash()
+	coordinator.Close()
+
+	restarted, err := NewNode(290, nodesConfig, WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to restart node: %v", err)
+	}
+	defer restarted.Close()
+
+	if got := restarted.State(); got != 3 {
+		t.Errorf("Expected state 3 after restart, got %d", got)
+	}
+	if seq, _ := restarted.(*node).volatileStore.LastCommitted(); seq != 3 {
+		t.Errorf("Expected commit sequence 3 after restart, got %d", seq)
+	}
+}
+
+func TestTracing_SpansEndedAfterCloseAreDropped(t *testing.T) {
+	// Use ID 294
+	var stdout bytes.Buffer
+	n, err := NewNode(294, generateNodes(294, 1), WithTracing(NewStdoutExporter(&stdout)), WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// RPC handlers and background resolution may still end spans once the
+	// node is closed.
+	if err := n.(*node).abort(uuid.New(), 294, []int{294}); err == nil {
+		t.Error("Expected the abort to fail on a closed store")
+	}
+	n.(*node).tracer.close()
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no span exported after close, got %s", stdout.String())
+	}
+}
+
+func TestCatchUp_StreamsLargeSnapshotsInChunks(t *testing.T) {
+	cleanLogs()
+	// Use IDs 295-296. Node 295 starts from a snapshot larger than a chunk
+	// whose commits were compacted away.
+	nodesConfig := generateNodes(295, 2)
+	entries := make([]string, 2000)
+	for i := range entries {
+		entries[i] = uuid.NewString() + uuid.NewString()
+	}
+	compacted := store.SnapshotData{
+		State:        []byte(strings.Join(entries, "\n")),
+		Seq:          1,
+		CommittedLog: map[uuid.UUID]uint64{uuid.New(): 1},
+	}
+	disk := store.NewMemoryDisk()
+	if err := store.NewMemoryStore(disk).SaveSnapshot(compacted); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	source, err := NewNode(295, generateNodes(295, 1), WithStateMachine(&journal{}), WithStableStore(store.NewMemoryStore(disk)))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer source.Close()
+
+	transfer, err := source.(*node).stateTransfer(0)
+	if err != nil || transfer.SnapshotID == 0 {
+		t.Fatalf("Expected a snapshot stream, got %+v, %v", transfer, err)
+	}
+	var chunks [][]byte
+	for offset := int64(0); ; {
+		chunk, err := source.(*node).snapshotChunk(SnapshotChunkArgs{SnapshotID: transfer.SnapshotID, Offset: offset})
+		if err != nil {
+			t.Fatalf("Fetching the chunk at %d failed: %v", offset, err)
+		}
+		// A lost reply is answered again.
+		again, err := source.(*node).snapshotChunk(SnapshotChunkArgs{SnapshotID: transfer.SnapshotID, Offset: offset})
+		if err != nil || !bytes.Equal(again.Data, chunk.Data) {
+			t.Fatalf("Expected the chunk at %d again, got %v", offset, err)
+		}
+		chunks = append(chunks, chunk.Data)
+		offset += int64(len(chunk.Data))
+		if chunk.Done {
+			break
+		}
+	}
+	if len(chunks) < 2 {
+		t.Errorf("Expected the snapshot in several chunks, got %d", len(chunks))
+	}
+	read, err := store.ReadSnapshot(bytes.NewReader(bytes.Join(chunks, nil)))
+	if err != nil || !bytes.Equal(read.State, compacted.State) {
+		t.Errorf("Streamed snapshot does not match: %v", err)
+	}
+	if _, err := source.(*node).snapshotChunk(SnapshotChunkArgs{SnapshotID: transfer.SnapshotID + 1}); !errors.Is(err, ErrSnapshotStreamClosed) {
+		t.Errorf("Expected ErrSnapshotStreamClosed for an unknown stream, got %v", err)
+	}
+
+	// A node joining over RPC receives the same state.
+	peerDisk := store.NewMemoryDisk()
+	peer, err := NewNode(296, nodesConfig, WithStateMachine(&journal{}), WithStableStore(store.NewMemoryStore(peerDisk)))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer peer.Close()
+	if err := peer.Repair(); err != nil {
+		t.Fatalf("Repair failed: %v", err)
+	}
+	state, err := peer.(*node).volatileStore.Snapshot()
+	if err != nil || !bytes.Equal(state, compacted.State) {
+		t.Errorf("Node did not catch up from the streamed snapshot: %d bytes, %v", len(state), err)
+	}
+}
+
+func TestNewNode_FailedRecoveryReleasesResources(t *testing.T) {
+	// Use ID 297
+	nodesConfig := generateNodes(297, 1)
+	disk := store.NewMemoryDisk()
+	if err := store.NewMemoryStore(disk).SaveSnapshot(store.SnapshotData{State: []byte("not a counter"), Seq: 1}); err != nil {
+		t.Fatalf("SaveSnapshot failed: %v", err)
+	}
+	s := &closeTrackingStore{StableStore: store.NewMemoryStore(disk)}
+
+	if _, err := NewNode(297, nodesConfig, WithStableStore(s), WithTracing(NewStdoutExporter(io.Discard))); err == nil {
+		t.Fatal("Expected recovery from a snapshot the state machine rejects to fail")
+	}
+	if !s.closed {
+		t.Error("Expected the stable store to be closed")
+	}
+
+	// The address was released, so the node starts again in the same
+	// process.
+	n, err := NewNode(297, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to start the node again: %v", err)
+	}
+	n.Close()
+}
+
+// closeTrackingStore records whether the node closed its stable store.
+type closeTrackingStore struct {
+	store.StableStore
+	closed bool
+}
+
+func (s *closeTrackingStore) Close() error {
+	s.closed = true
+	return s.StableStore.Close()
+}
+
+func TestValidationHook_SharedRejectReasonIsNotModified(t *testing.T) {
+	sentinel := &RejectReason{Message: "closed for the day"}
+
+	reason := newRejectReason(3, REJECT_VALIDATION_FAILED, fmt.Errorf("hook: %w", sentinel))
+	if reason.NodeID != 3 || reason.Code != REJECT_VALIDATION_FAILED || reason.Message != sentinel.Message {
+		t.Errorf("Unexpected reject reason: %+v", reason)
+	}
+	if sentinel.NodeID != 0 || sentinel.Code != "" {
+		t.Errorf("Validator's reason was modified: %+v", sentinel)
+	}
+}
+
+func TestGetStatus_InDoubtParticipantWaitsForUndecidedCoordinator(t *testing.T) {
+	cleanLogs()
+	// Use IDs 298-299
+	nodesConfig := generateNodes(298, 2)
+	coordinator, err := NewNode(298, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	participant, err := NewNode(299, nodesConfig, WithDataDir(t.TempDir()))
+	if err != nil {
+		coordinator.Close()
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer teardown([]Node{coordinator, participant})
+
+	// The coordinator is still in its prepare phase, and the participant
+	// voted yes and awaits the outcome.
+	c, p := coordinator.(*node), participant.(*node)
+	participants := []int{298, 299}
+	txID := uuid.New()
+	for _, n := range []*node{c, p} {
+		if err := n.prepare(txID, store.CounterAdd(1), nil, 298, participants); err != nil {
+			t.Fatalf("Prepare failed: %v", err)
+		}
+	}
+
+	var status store.TransactionState
+	if err := newNodeRPC(c).GetStatus(txID, &status); err != nil {
+		t.Fatalf("GetStatus failed: %v", err)
+	}
+	if status != store.TRANSACTION_PREPARED {
+		t.Errorf("Expected the undecided transaction to be PREPARED, got %v", status)
+	}
+
+	// Resolving the participant does not presume an abort the coordinator
+	// has not decided.
+	resolved := make(chan struct{})
+	go func() {
+		defer close(resolved)
+		p.resolveAnomaly(store.Entry{TxID: txID, SenderID: 298, Command: store.CounterAdd(1), Participants: participants})
+	}()
+	time.Sleep(300 * time.Millisecond)
+	if !p.isPending(txID) {
+		t.Fatal("Expected the participant to keep waiting while the coordinator prepares")
+	}
+
+	if err := c.commit(txID, store.CounterAdd(1), 298, participants); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	select {
+	case <-resolved:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Participant did not resolve the transaction")
+	}
+	if p.State() != 1 || c.State() != 1 {
+		t.Errorf("Expected both nodes to commit, got %d and %d", c.State(), p.State())
+	}
+	if err := newNodeRPC(p).GetStatus(txID, &status); err != nil || status != store.TRANSACTION_COMMITTED {
+		t.Errorf("Expected the participant to report COMMITTED, got %v, %v", status, err)
+	}
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// DefaultVersionRetention is the number of state versions a node keeps
+// across snapshots unless configured with WithVersionRetention.
+const DefaultVersionRetention = 64
+
+// DefaultDataDir is where a node keeps its WAL and snapshots unless
+// configured with WithDataDir.
+const DefaultDataDir = "./logs"
+
+// Option configures a node created by NewNode.
+type Option func(*options)
+
+type options struct {
+	dataDir          string
+	listenAddress    string
+	timeouts         Timeouts
+	adminAddress     string
+	tlsConfig        *tls.Config
+	spanExporter     SpanExporter
+	keys             store.KeyProvider
+	stableStore      store.StableStore
+	stateMachine     store.StateMachine
+	versionRetention int
+
+	antiEntropyInterval time.Duration
+	snapshotPolicy      SnapshotPolicy
+}
+
+func (o options) storeOptions() []store.StoreOption {
+	if o.keys == nil {
+		return nil
+	}
+	return []store.StoreOption{store.WithEncryption(o.keys)}
+}
+
+// WithDataDir makes the default file WAL keep its files in dir, which only
+// one node at a time can use. It has no effect with WithStableStore.
+func WithDataDir(dir string) Option {
+	return func(o *options) {
+		o.dataDir = dir
+	}
+}
+
+// WithListenAddress makes the node accept RPCs on addr instead of its own
+// entry of the nodes passed to NewNode, which is then only the address peers
+// dial. Use it to bind all interfaces, e.g. ":3001", behind a container or
+// a load balancer.
+func WithListenAddress(addr string) Option {
+	return func(o *options) {
+		o.listenAddress = addr
+	}
+}
+
+// WithTimeouts sets how long the node waits on its peers, see Timeouts. A
+// zero field keeps its default.
+func WithTimeouts(t Timeouts) Option {
+	return func(o *options) {
+		if t.Dial > 0 {
+			o.timeouts.Dial = t.Dial
+		}
+		if t.RPC > 0 {
+			o.timeouts.RPC = t.RPC
+		}
+	}
+}
+
+// WithTLS makes the node serve its RPCs over TLS and dial its peers with
+// TLS, both with config. For mutual authentication config holds the node's
+// certificate and the CA in both RootCAs and ClientCAs, with ClientAuth set.
+func WithTLS(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithTracing makes the node record spans for the transactions it takes part
+// in and send them to exporter, see NewStdoutExporter and NewOTLPExporter.
+func WithTracing(exporter SpanExporter) Option {
+	return func(o *options) {
+		o.spanExporter = exporter
+	}
+}
+
+// WithAdmin makes the node serve its admin endpoint over HTTP on addr, see
+// admin.go.
+func WithAdmin(addr string) Option {
+	return func(o *options) {
+		o.adminAddress = addr
+	}
+}
+
+// WithEncryption makes the default file WAL encrypt its records and
+// snapshots with AES-GCM under keys, see store.WithEncryption. It has no
+// effect with WithStableStore: pass store.WithEncryption to the store instead.
+func WithEncryption(keys store.KeyProvider) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
+// WithStableStore makes the node persist its WAL and snapshots in s instead
+// of the default gob file WAL. The node takes ownership of s and closes it on
+// Close.
+func WithStableStore(s store.StableStore) Option {
+	return func(o *options) {
+		o.stableStore = s
+	}
+}
+
+// WithStateMachine makes the node drive sm through 2PC instead of the default
+// Counter. Transaction and State only work with the Counter; other state
+// machines are driven with Submit.
+func WithStateMachine(sm store.StateMachine) Option {
+	return func(o *options) {
+		o.stateMachine = sm
+	}
+}
+
+// WithVersionRetention sets how many of the most recent state versions
+// survive the garbage collection run on every snapshot. Older versions can
+// no longer be read with ReadAt.
+func WithVersionRetention(n int) Option {
+	return func(o *options) {
+		o.versionRetention = n
+	}
+}
+
+// WithAntiEntropy makes the node compare itself with its peers every
+// interval and replay the commits it misses, see Repair.
+func WithAntiEntropy(interval time.Duration) Option {
+	return func(o *options) {
+		o.antiEntropyInterval = interval
+	}
+}
+
+// WithSnapshotPolicy makes the node snapshot its state and compact its WAL in
+// the background according to p. Without it, snapshots are only taken on
+// startup or with TakeSnapshot.
+func WithSnapshotPolicy(p SnapshotPolicy) Option {
+	return func(o *options) {
+		o.snapshotPolicy = p
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"crypto/tls"
 	"errors"
 	"log/slog"
 	"net"
@@ -12,68 +13,174 @@ import (
 type Peer interface {
 	ID() int
 	Call(method string, args, reply any) error
+	// Status reports how the last calls to the peer went.
+	Status() PeerStatus
 	Close() error
 }
 
+// PeerStatus is the connectivity of a node to one of its peers, as seen from
+// the calls it made. Peers are dialed on first use, so a peer never called
+// has a zero LastContact.
+type PeerStatus struct {
+	ID      int    `json:"id"`
+	Address string `json:"address"`
+	// Connected reports whether a connection to the peer is open.
+	Connected   bool      `json:"connected"`
+	LastContact time.Time `json:"last_contact"`
+	// LastError is the error of the last call if the peer could not be
+	// reached, empty if it answered.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Timeouts bound the calls a node makes to its peers.
+type Timeouts struct {
+	// Dial is how long connecting to a peer may take.
+	Dial time.Duration
+	// RPC is how long a peer may take to answer a call.
+	RPC time.Duration
+}
+
+var errRPCTimeout = errors.New("rpc call timed out")
+
+// DefaultTimeouts are the timeouts of a node unless configured with
+// WithTimeouts.
+var DefaultTimeouts = Timeouts{Dial: 2 * time.Second, RPC: 5 * time.Second}
+
 type peer struct {
-	mu      sync.Mutex
-	id      int
-	address string
-	client  *rpc.Client
-	logger  *slog.Logger
+	mu        sync.Mutex
+	id        int
+	address   string
+	timeouts  Timeouts
+	tlsConfig *tls.Config
+	client    *rpc.Client
+	logger    *slog.Logger
+	// metrics, when set, counts the calls that failed to reach the peer.
+	metrics *metrics
+
+	// statusMu guards status apart from mu, which is held for whole calls.
+	statusMu sync.Mutex
+	status   PeerStatus
 }
 
 func (p *peer) ID() int {
 	return p.id
 }
 
+func (p *peer) Status() PeerStatus {
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	return p.status
+}
+
 func (p *peer) Close() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if p.client != nil {
 		p.logger.Info("Closing peer connection")
-		return p.client.Close()
+		err := p.client.Close()
+		p.setClient(nil)
+		return err
 	}
 	return nil
 }
 
+// setClient replaces the connection to the peer, nil when it was closed.
+// It must be called with mu held.
+func (p *peer) setClient(client *rpc.Client) {
+	p.client = client
+
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	p.status.Connected = client != nil
+}
+
 func (p *peer) Call(method string, args any, reply any) error {
+	err := p.call(method, args, reply)
+
+	// An error returned by the peer's handler still means it answered.
+	reached := err == nil || isServerError(err)
+
+	if !reached && p.metrics != nil {
+		p.metrics.observePeerError(p.id, method, err)
+	}
+
+	p.statusMu.Lock()
+	defer p.statusMu.Unlock()
+	if reached {
+		p.status.LastContact = time.Now()
+		p.status.LastError = ""
+	} else {
+		p.status.LastError = err.Error()
+	}
+	return err
+}
+
+func (p *peer) call(method string, args any, reply any) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	if p.client == nil {
 		p.logger.Debug("Dialing peer")
-		conn, err := net.DialTimeout("tcp", p.address, 2*time.Second)
+		conn, err := p.dial()
 		if err != nil {
 			p.logger.Warn("Failed to dial peer", "error", err)
 			return err
 		}
-		p.client = rpc.NewClient(conn)
+		p.setClient(rpc.NewClient(conn))
 	}
 
 	call := p.client.Go(method, args, reply, nil)
 
 	select {
 	case <-call.Done:
-		if call.Error == rpc.ErrShutdown {
-			p.logger.Warn("RPC connection shutdown, resetting client")
+		// Any error but one returned by the peer's handler means the
+		// connection is gone.
+		if call.Error != nil && !isServerError(call.Error) {
+			p.logger.Warn("RPC connection lost, resetting client", "error", call.Error)
 			p.client.Close()
-			p.client = nil
+			p.setClient(nil)
 		}
 		return call.Error
 
-	case <-time.After(5 * time.Second):
+	case <-time.After(p.timeouts.RPC):
 		p.logger.Warn("RPC call timed out, closing connection")
 		p.client.Close()
-		p.client = nil
-		return errors.New("rpc call timed out")
+		p.setClient(nil)
+		return errRPCTimeout
+	}
+}
+
+func isServerError(err error) bool {
+	var serverErr rpc.ServerError
+	return errors.As(err, &serverErr)
+}
+
+func (p *peer) dial() (net.Conn, error) {
+	if p.tlsConfig == nil {
+		return net.DialTimeout("tcp", p.address, p.timeouts.Dial)
 	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: p.timeouts.Dial}, "tcp", p.address, p.tlsConfig)
+}
+
+// callTimeout is the longest a call to the peer can take.
+func (p *peer) callTimeout() time.Duration {
+	return p.timeouts.Dial + p.timeouts.RPC
+}
+
+// NewPeer returns a client for the node at address. A nil tlsConfig dials
+// plain TCP.
+func NewPeer(id int, address string, timeouts Timeouts, tlsConfig *tls.Config, logger *slog.Logger) Peer {
+	return newPeer(id, address, timeouts, tlsConfig, logger, nil)
 }
 
-func NewPeer(id int, address string, logger *slog.Logger) Peer {
+func newPeer(id int, address string, timeouts Timeouts, tlsConfig *tls.Config, logger *slog.Logger, m *metrics) *peer {
 	return &peer{
-		id:      id,
-		address: address,
-		logger:  logger.With("peer_scope", "client", "target_peer_id", id),
+		id:        id,
+		address:   address,
+		timeouts:  timeouts,
+		tlsConfig: tlsConfig,
+		status:    PeerStatus{ID: id, Address: address},
+		metrics:   m,
+		logger:    logger.With("peer_scope", "client", "target_peer_id", id),
 	}
 }
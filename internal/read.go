@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// ErrInDoubt is returned by Read when the outcome of a transaction this node
+// prepared can be learned neither from its coordinator nor from the other
+// participants.
+var ErrInDoubt = errors.New("in-doubt transaction could not be resolved")
+
+// Read returns a snapshot of the state machine as of the last transaction
+// committed in the cluster.
+//
+// A participant that voted yes may not have received the Commit yet, so its
+// local state can lag behind nodes that did. Before reading, every such
+// pending transaction is looked up with its coordinator: the coordinator
+// decides before anyone applies, so one it has not committed is not visible
+// anywhere yet and can be left out, while one it has committed is committed
+// here too. If the outcome cannot be learned, Read fails with ErrInDoubt
+// rather than return torn state.
+func (n *node) Read() ([]byte, error) {
+	for _, e := range n.pendingTransactions() {
+		status, err := n.outcome(e)
+		if err != nil {
+			return nil, err
+		}
+
+		if status == store.TRANSACTION_COMMITTED {
+			n.logger.Info("Read found transaction committed by its coordinator", "txID", e.TxID)
+			if err := n.commit(e.TxID, e.Command, e.SenderID, e.Participants); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return n.volatileStore.Snapshot()
+}
+
+// outcome returns the state of a pending transaction as seen by its
+// coordinator, falling back to the other participants when the coordinator
+// cannot be reached.
+func (n *node) outcome(e store.Entry) (store.TransactionState, error) {
+	if e.SenderID == n.id {
+		return n.getStatus(e.TxID)
+	}
+
+	if coordinator := n.peer(e.SenderID); coordinator != nil {
+		var status store.TransactionState
+		err := coordinator.Call("Node.GetStatus", e.TxID, &status)
+		if err == nil {
+			return status, nil
+		}
+		n.logger.Warn("Failed to contact coordinator during read", "txID", e.TxID, "error", err)
+	}
+
+	if n.committedByParticipant(e.TxID, e.SenderID, e.Participants) {
+		return store.TRANSACTION_COMMITTED, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrInDoubt, e.TxID)
+}
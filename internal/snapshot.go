@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// snapshotPollInterval is how often a node checks its snapshot policy.
+const snapshotPollInterval = 100 * time.Millisecond
+
+// SnapshotPolicy decides when a node snapshots its state and compacts its WAL
+// in the background. A snapshot is taken once the WAL grew by Records
+// records, holds Bytes bytes, or Interval elapsed since the last snapshot,
+// whichever comes first. Zero fields are disabled.
+type SnapshotPolicy struct {
+	Records  int
+	Bytes    int64
+	Interval time.Duration
+}
+
+// DefaultSnapshotPolicy is the background snapshot policy of nodes run from
+// a ClusterConfig that sets none. It keeps the WAL, the committed history and
+// the retained versions bounded on a node left running.
+var DefaultSnapshotPolicy = SnapshotPolicy{Records: 10000, Bytes: 64 << 20, Interval: 10 * time.Minute}
+
+func (p SnapshotPolicy) enabled() bool {
+	return p.Records > 0 || p.Bytes > 0 || p.Interval > 0
+}
+
+// due reports whether the policy calls for a snapshot, given the WAL stats
+// and the last snapshot. Nothing is due until a record was written since.
+func (p SnapshotPolicy) due(stats store.LogStats, last SnapshotInfo) bool {
+	if stats.LastLSN <= last.LSN {
+		return false
+	}
+
+	return p.Records > 0 && stats.LastLSN-last.LSN >= uint64(p.Records) ||
+		p.Bytes > 0 && stats.Bytes >= p.Bytes ||
+		p.Interval > 0 && time.Since(last.Taken) >= p.Interval
+}
+
+// SnapshotInfo describes a snapshot. LSN is the log sequence number of the
+// last WAL record it covers, and Seq the commit sequence number of the last
+// transaction it includes.
+type SnapshotInfo struct {
+	LSN   uint64    `json:"lsn"`
+	Seq   uint64    `json:"seq"`
+	Taken time.Time `json:"taken"`
+}
+
+func (n *node) LastSnapshot() SnapshotInfo {
+	n.lastSnapshotMu.Lock()
+	defer n.lastSnapshotMu.Unlock()
+	return n.lastSnapshot
+}
+
+func (n *node) setLastSnapshot(info SnapshotInfo) {
+	n.lastSnapshotMu.Lock()
+	defer n.lastSnapshotMu.Unlock()
+	n.lastSnapshot = info
+}
+
+// TakeSnapshot snapshots the state and compacts the WAL while the node keeps
+// serving transactions. Commits are only held back while the state and the
+// WAL position are read together; the snapshot is then written, and the
+// records it covers dropped, alongside new prepares and commits.
+func (n *node) TakeSnapshot() (SnapshotInfo, error) {
+	n.snapshotMu.Lock()
+	defer n.snapshotMu.Unlock()
+
+	n.commitMu.Lock()
+	stats, err := n.stableStore.Stats()
+	if err != nil {
+		n.commitMu.Unlock()
+		return SnapshotInfo{}, err
+	}
+	data, err := n.volatileStore.Checkpoint()
+	if err != nil {
+		n.commitMu.Unlock()
+		return SnapshotInfo{}, err
+	}
+	// Prepares track their transaction before writing its record, so every
+	// PREPARED record up to the LSN read above is either kept or resolved.
+	var keep []uuid.UUID
+	for _, e := range n.pendingTransactions() {
+		keep = append(keep, e.TxID)
+	}
+	n.commitMu.Unlock()
+
+	data.LSN = stats.LastLSN
+	if err := n.stableStore.SaveSnapshot(*data); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := n.stableStore.Compact(data.LSN, keep...); err != nil {
+		return SnapshotInfo{}, err
+	}
+	n.volatileStore.PruneVersions(n.versionRetention)
+
+	info := SnapshotInfo{LSN: data.LSN, Seq: data.Seq, Taken: time.Now()}
+	n.setLastSnapshot(info)
+	n.logger.Info("Took snapshot", "lsn", info.LSN, "seq", info.Seq, "kept", len(keep))
+	return info, nil
+}
+
+func (n *node) runSnapshotPolicy(policy SnapshotPolicy) {
+	ticker := time.NewTicker(snapshotPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			stats, err := n.stableStore.Stats()
+			if err != nil {
+				n.logger.Warn("Failed to read WAL stats", "error", err)
+				continue
+			}
+			if !policy.due(stats, n.LastSnapshot()) {
+				continue
+			}
+			if _, err := n.TakeSnapshot(); err != nil {
+				n.logger.Error("Background snapshot failed", "error", err)
+			}
+		}
+	}
+}
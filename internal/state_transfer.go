@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+// ErrSnapshotStreamClosed is returned when fetching a chunk of a snapshot
+// stream that finished, expired or was never opened.
+var ErrSnapshotStreamClosed = errors.New("snapshot stream closed")
+
+// snapshotStreamIdleTimeout is how long a snapshot stream waits for its next
+// chunk to be fetched before it is dropped.
+const snapshotStreamIdleTimeout = 30 * time.Second
+
+// StateTransfer is what a peer sends a node catching up from a commit
+// sequence number: a snapshot when the commits following it were compacted
+// away, and the commits following the snapshot, or the requested one. The
+// snapshot is not part of the reply: it is streamed in the format of
+// store.WriteSnapshot, one chunk per FetchSnapshot call.
+type StateTransfer struct {
+	// SnapshotID, when not zero, identifies the snapshot stream to fetch
+	// and install before applying Commits.
+	SnapshotID uint64
+	Commits    []store.Entry
+}
+
+// SnapshotChunkArgs asks for the chunk of a snapshot stream at Offset.
+// Chunks are served in order; the last one can be asked for again, when its
+// reply was lost.
+type SnapshotChunkArgs struct {
+	SnapshotID uint64
+	Offset     int64
+}
+
+// SnapshotChunk is a piece of a snapshot stream. Done marks the last one.
+type SnapshotChunk struct {
+	Data []byte
+	Done bool
+}
+
+// snapshotStream is a snapshot being sent to a peer. The snapshot is encoded
+// into the pipe as chunks are fetched, so no more than a chunk of it is ever
+// held encoded.
+type snapshotStream struct {
+	mu     sync.Mutex
+	r      *io.PipeReader
+	offset int64
+	// last is the chunk served last, at offset - len(last.Data).
+	last  SnapshotChunk
+	timer *time.Timer
+}
+
+func (n *node) stateTransfer(after uint64) (StateTransfer, error) {
+	commits, err := n.volatileStore.Commits(after)
+	if !errors.Is(err, store.ErrCommitsPruned) {
+		return StateTransfer{Commits: commits}, err
+	}
+
+	// The checkpoint is read atomically, so no commit follows it yet.
+	snapshot, err := n.volatileStore.Checkpoint()
+	if err != nil {
+		return StateTransfer{}, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(store.WriteSnapshot(w, snapshot))
+	}()
+	return StateTransfer{SnapshotID: n.openSnapshotStream(r)}, nil
+}
+
+func (n *node) openSnapshotStream(r *io.PipeReader) uint64 {
+	n.streamsMu.Lock()
+	defer n.streamsMu.Unlock()
+
+	n.lastStreamID++
+	id := n.lastStreamID
+	n.streams[id] = &snapshotStream{
+		r:     r,
+		timer: time.AfterFunc(snapshotStreamIdleTimeout, func() { n.closeSnapshotStream(id) }),
+	}
+	return id
+}
+
+// closeSnapshotStream drops a stream, which stops encoding its snapshot.
+func (n *node) closeSnapshotStream(id uint64) {
+	n.streamsMu.Lock()
+	stream, ok := n.streams[id]
+	delete(n.streams, id)
+	n.streamsMu.Unlock()
+
+	if ok {
+		stream.timer.Stop()
+		stream.r.CloseWithError(ErrSnapshotStreamClosed)
+	}
+}
+
+func (n *node) snapshotChunk(args SnapshotChunkArgs) (SnapshotChunk, error) {
+	n.streamsMu.Lock()
+	stream, ok := n.streams[args.SnapshotID]
+	n.streamsMu.Unlock()
+	if !ok {
+		return SnapshotChunk{}, ErrSnapshotStreamClosed
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	switch args.Offset {
+	case stream.offset:
+		if stream.last.Done {
+			return SnapshotChunk{Done: true}, nil
+		}
+	case stream.offset - int64(len(stream.last.Data)):
+		return stream.last, nil
+	default:
+		return SnapshotChunk{}, fmt.Errorf("snapshot stream %d is at offset %d, not %d", args.SnapshotID, stream.offset, args.Offset)
+	}
+
+	buf := make([]byte, store.SnapshotChunkSize)
+	k, err := io.ReadFull(stream.r, buf)
+	chunk := SnapshotChunk{Data: buf[:k]}
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		chunk.Done = true
+	case err != nil:
+		n.closeSnapshotStream(args.SnapshotID)
+		return SnapshotChunk{}, err
+	}
+
+	stream.offset += int64(k)
+	stream.last = chunk
+	stream.timer.Reset(snapshotStreamIdleTimeout)
+	// The last chunk stays available for a retry until the stream expires.
+	if chunk.Done {
+		stream.r.Close()
+	}
+	return chunk, nil
+}
+
+// snapshotReader reads a snapshot stream from a peer, one chunk at a time.
+type snapshotReader struct {
+	peer   Peer
+	id     uint64
+	offset int64
+	buf    []byte
+	done   bool
+}
+
+func (r *snapshotReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		var chunk SnapshotChunk
+		if err := r.peer.Call("Node.FetchSnapshot", SnapshotChunkArgs{SnapshotID: r.id, Offset: r.offset}, &chunk); err != nil {
+			return 0, err
+		}
+		r.buf, r.done = chunk.Data, chunk.Done
+		r.offset += int64(len(chunk.Data))
+	}
+
+	k := copy(p, r.buf)
+	r.buf = r.buf[k:]
+	return k, nil
+}
+
+// catchUp fetches what the node misses after commit seq after from the peer
+// and applies it: the snapshot first, if any, then the commits in order.
+func (n *node) catchUp(p Peer, after uint64) error {
+	var transfer StateTransfer
+	if err := p.Call("Node.FetchState", after, &transfer); err != nil {
+		return err
+	}
+
+	if transfer.SnapshotID != 0 {
+		snapshot, err := store.ReadSnapshot(&snapshotReader{peer: p, id: transfer.SnapshotID})
+		if err != nil {
+			return err
+		}
+		if err := n.installSnapshot(snapshot); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range transfer.Commits {
+		if err := n.applyCommitted(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installSnapshot replaces the local state with a snapshot received from a
+// peer and persists it. The WAL is left alone: its commits are part of the
+// snapshot, and its in-doubt records are still needed.
+func (n *node) installSnapshot(data *store.SnapshotData) error {
+	// A snapshot taken concurrently must not overwrite this one.
+	n.snapshotMu.Lock()
+	defer n.snapshotMu.Unlock()
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+
+	if last, _ := n.volatileStore.LastCommitted(); data.Seq <= last {
+		return nil
+	}
+
+	// The LSN of the peer means nothing here, and the snapshot covers no
+	// more of the local log than the previous one did.
+	installed := *data
+	installed.LSN = n.LastSnapshot().LSN
+
+	if err := n.stableStore.SaveSnapshot(installed); err != nil {
+		return err
+	}
+	if err := n.volatileStore.Recover(data); err != nil {
+		return err
+	}
+
+	for _, e := range n.pendingTransactions() {
+		if n.volatileStore.IsCommitted(e.TxID) {
+			n.untrackPending(e.TxID)
+		}
+	}
+
+	n.logger.Info("Installed snapshot from peer", "seq", data.Seq, "committed", len(data.CommittedLog))
+	return nil
+}
+
+// applyCommitted persists and applies a transaction a peer committed, the
+// same way recovery replays the WAL.
+func (n *node) applyCommitted(e store.Entry) error {
+	n.commitMu.Lock()
+	defer n.commitMu.Unlock()
+
+	if n.volatileStore.IsCommitted(e.TxID) {
+		return nil
+	}
+
+	if last, _ := n.volatileStore.LastCommitted(); e.Seq != last+1 {
+		return fmt.Errorf("commit %d of %s does not follow local commit %d", e.Seq, e.TxID, last)
+	}
+
+	if err := n.stableStore.WriteCommited(e.TxID, e.Command, e.Seq, e.SenderID, e.Participants); err != nil {
+		return err
+	}
+	if err := n.volatileStore.Replay(e); err != nil {
+		return err
+	}
+	n.untrackPending(e.TxID)
+
+	n.logger.Info("Replayed commit from peer", "txID", e.TxID, "seq", e.Seq)
+	return nil
+}
@@ -0,0 +1,359 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	walBucket      = []byte("wal")
+	snapshotBucket = []byte("snapshot")
+	snapshotKey    = []byte("latest")
+)
+
+// boltStore keeps the WAL and the snapshot in an embedded bbolt database.
+// Every record is its own bolt transaction, which bbolt fsyncs on commit.
+type boltStore struct {
+	nodeID int
+	db     *bolt.DB
+	lock   *os.File
+	sealer *sealer
+
+	// lsn is the last log sequence number assigned. It is only advanced
+	// inside a write transaction, which bbolt runs one at a time.
+	mu  sync.Mutex
+	lsn uint64
+}
+
+func (s *boltStore) ReplayLog(callback func(Entry) error) error {
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := callback(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entries decodes the whole log, so callbacks never run inside a bolt
+// transaction and are free to write to the store.
+func (s *boltStore) entries() ([]Entry, error) {
+	var entries []Entry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(walBucket).ForEach(func(_, v []byte) error {
+			e, err := s.decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+func (s *boltStore) decodeEntry(v []byte) (Entry, error) {
+	var e Entry
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&e); err != nil {
+		return Entry{}, err
+	}
+	return s.sealer.openEntry(e)
+}
+
+func (s *boltStore) GetTransactionState(txID uuid.UUID) (TransactionState, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	// Default to Aborted (Presumed Abort) if not found
+	finalState := TRANSACTION_ABORTED
+	for _, e := range entries {
+		if e.TxID == txID && e.State == TRANSACTION_COMMITTED {
+			finalState = TRANSACTION_COMMITTED
+		}
+	}
+
+	return finalState, nil
+}
+
+func (s *boltStore) SaveSnapshot(data SnapshotData) error {
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, &data, s.sealer); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotBucket).Put(snapshotKey, buf.Bytes())
+	})
+}
+
+func (s *boltStore) LoadSnapshot() (*SnapshotData, error) {
+	var data *SnapshotData
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(snapshotBucket).Get(snapshotKey)
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		data, err = readSnapshot(bytes.NewReader(v), s.sealer)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (s *boltStore) RecoverLastState() (*Entry, error) {
+	var lastState Entry
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		_, v := tx.Bucket(walBucket).Cursor().Last()
+		if v == nil {
+			return nil
+		}
+		var err error
+		lastState, err = s.decodeEntry(v)
+		return err
+	})
+	if err != nil {
+		return &lastState, fmt.Errorf("potential corruption at end of log: %w", err)
+	}
+
+	return &lastState, nil
+}
+
+func (s *boltStore) Truncate(keep ...Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(walBucket); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucket(walBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range keep {
+			if err := s.putEntry(b, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Compact(lsn uint64, keep ...uuid.UUID) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var log []Entry
+		err := tx.Bucket(walBucket).ForEach(func(_, v []byte) error {
+			e, err := s.decodeEntry(v)
+			if err != nil {
+				return err
+			}
+			log = append(log, e)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(walBucket); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucket(walBucket)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range compactLog(log, lsn, keep) {
+			if err := s.putEntry(b, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Stats() (LogStats, error) {
+	var stats LogStats
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(walBucket).ForEach(func(_, v []byte) error {
+			stats.Records++
+			stats.Bytes += int64(len(v))
+			return nil
+		})
+	})
+
+	s.mu.Lock()
+	stats.LastLSN = s.lsn
+	s.mu.Unlock()
+
+	return stats, err
+}
+
+func (s *boltStore) WriteAborted(txID uuid.UUID, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		State:        TRANSACTION_ABORTED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *boltStore) WriteCommited(txID uuid.UUID, cmd []byte, seq uint64, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		Command:      cmd,
+		Seq:          seq,
+		State:        TRANSACTION_COMMITTED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *boltStore) WritePrepared(txID uuid.UUID, cmd []byte, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		Command:      cmd,
+		State:        TRANSACTION_PREPARED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *boltStore) writeLog(entry Entry) error {
+	entry.Timestamp = time.Now()
+	entry.Version = PROTOCOL_VERSION
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		entry.LSN = s.lsn + 1
+		if err := s.putEntry(tx.Bucket(walBucket), entry); err != nil {
+			return err
+		}
+		s.lsn = entry.LSN
+		return nil
+	})
+}
+
+// putEntry appends the entry to the bucket under the next sequence number,
+// big-endian encoded so that cursor order is log order. The entry is sealed
+// if the store is encrypted.
+func (s *boltStore) putEntry(b *bolt.Bucket, entry Entry) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	record, err := s.sealer.sealEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return b.Put(key, buf.Bytes())
+}
+
+func (s *boltStore) Close() error {
+	return errors.Join(s.db.Close(), s.lock.Close())
+}
+
+// NewBoltStore opens (or creates) the bbolt database of a node in dataDir,
+// and locks the directory so no other store can open it meanwhile.
+func NewBoltStore(dataDir string, nodeID int, opts ...StoreOption) (StableStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	lock, err := lockDataDir(dataDir, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := openBoltStore(dataDir, nodeID, newSealer(opts))
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.lock = lock
+
+	return s, nil
+}
+
+func openBoltStore(dataDir string, nodeID int, sealer *sealer) (*boltStore, error) {
+	filename := filepath.Join(dataDir, fmt.Sprintf("node_%d.db", nodeID))
+
+	db, err := bolt.Open(filename, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{walBucket, snapshotBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &boltStore{
+		nodeID: nodeID,
+		db:     db,
+		sealer: sealer,
+	}
+
+	// Resume log sequence numbers after the last one written, by the log
+	// or the snapshot.
+	last, err := s.RecoverLastState()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	snapshot, err := s.LoadSnapshot()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.lsn = last.LSN
+	if snapshot != nil {
+		s.lsn = max(s.lsn, snapshot.LSN)
+	}
+
+	return s, nil
+}
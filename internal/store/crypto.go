@@ -0,0 +1,275 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrEncrypted  = errors.New("record is encrypted and no key provider is configured")
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// KeyProvider hands out the AES keys (16, 24 or 32 bytes) records are
+// encrypted with. Keys are identified, so that records sealed with a key
+// that was since rotated out can still be opened.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are sealed with.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id string) ([]byte, error)
+}
+
+// StoreOption configures a stable store opened by NewStableStore or
+// NewBoltStore.
+type StoreOption func(*storeOptions)
+
+type storeOptions struct {
+	keys   KeyProvider
+	onSync func(time.Duration)
+}
+
+func newStoreOptions(opts []StoreOption) storeOptions {
+	var o storeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithEncryption makes the store encrypt every WAL record and snapshot with
+// AES-GCM under the current key of keys. Records written before the key was
+// rotated stay readable, and are sealed with the new key when the next
+// snapshot compacts the log.
+func WithEncryption(keys KeyProvider) StoreOption {
+	return func(o *storeOptions) {
+		o.keys = keys
+	}
+}
+
+// sealer encrypts records at rest. A nil sealer stores them as plaintext.
+//
+// A sealed value is laid out as the length of the key ID (one byte), the key
+// ID, the GCM nonce and the ciphertext.
+type sealer struct {
+	keys KeyProvider
+}
+
+func newSealer(opts []StoreOption) *sealer {
+	o := newStoreOptions(opts)
+	if o.keys == nil {
+		return nil
+	}
+	return &sealer{keys: o.keys}
+}
+
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	id, key, err := s.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("key ID %q is longer than 255 bytes", id)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte{byte(len(id))}, id...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, nil), nil
+}
+
+func (s *sealer) open(sealed []byte) ([]byte, error) {
+	if s == nil {
+		return nil, ErrEncrypted
+	}
+
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, errors.New("truncated encrypted record")
+	}
+	id, rest := string(sealed[1:1+sealed[0]]), sealed[1+sealed[0]:]
+
+	key, err := s.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("truncated encrypted record")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealEntry returns the record to write for e: e itself without encryption,
+// otherwise a record holding only e, encrypted.
+func (s *sealer) sealEntry(e Entry) (Entry, error) {
+	if s == nil {
+		return e, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return Entry{}, err
+	}
+
+	sealed, err := s.seal(buf.Bytes())
+	return Entry{Sealed: sealed}, err
+}
+
+// openEntry returns the entry a record read from the log holds.
+func (s *sealer) openEntry(e Entry) (Entry, error) {
+	if e.Sealed == nil {
+		return e.upgrade(), nil
+	}
+
+	plaintext, err := s.open(e.Sealed)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	var opened Entry
+	err = gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&opened)
+	return opened.upgrade(), err
+}
+
+// FileKeyProvider keeps keys in a local file, one "<id> <hex key>" line per
+// key. The last line is the current key.
+type FileKeyProvider struct {
+	mu      sync.RWMutex
+	path    string
+	keys    map[string][]byte
+	current string
+}
+
+// NewFileKeyProvider loads the keys of the file at path, which is created
+// with a fresh key if it does not exist.
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	p := &FileKeyProvider{path: path, keys: make(map[string][]byte)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, err := p.Rotate(); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<id> <hex key>\"", path, line)
+		}
+
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		p.keys[fields[0]] = key
+		p.current = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if p.current == "" {
+		return nil, fmt.Errorf("%s: no key", path)
+	}
+	return p, nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (string, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id string) ([]byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Rotate generates a new AES-256 key, appends it to the file and makes it the
+// current key. Previous keys are kept to open what they sealed.
+func (p *FileKeyProvider) Rotate() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	// IDs are random rather than counted, so a key file edited by hand
+	// never gets a new key under the ID of one it holds.
+	var id string
+	for id == "" || p.keys[id] != nil {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		id = fmt.Sprintf("key-%x", suffix)
+	}
+
+	f, err := os.OpenFile(p.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(f, "%s %x\n", id, key); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	p.keys[id] = key
+	p.current = id
+	return id, nil
+}
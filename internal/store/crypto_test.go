@@ -0,0 +1,148 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestStableStore_SealsWALAndSnapshotsAtRest(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewFileKeyProvider(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatalf("Failed to create key file: %v", err)
+	}
+	s, err := NewStableStore(dir, 1, WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("NewStableStore failed: %v", err)
+	}
+	defer func() { s.Close() }()
+
+	snapshotted, logged := uuid.New(), uuid.New()
+	commit := func(txID uuid.UUID, seq uint64) {
+		t.Helper()
+		if err := s.WritePrepared(txID, CounterAdd(1), 1, []int{1}); err != nil {
+			t.Fatalf("WritePrepared failed: %v", err)
+		}
+		if err := s.WriteCommited(txID, CounterAdd(1), seq, 1, []int{1}); err != nil {
+			t.Fatalf("WriteCommited failed: %v", err)
+		}
+	}
+	snapshot := func(seq uint64) {
+		t.Helper()
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatalf("Stats failed: %v", err)
+		}
+		err = s.SaveSnapshot(SnapshotData{
+			State:        EncodeCounterState(int(seq)),
+			LSN:          stats.LastLSN,
+			Seq:          seq,
+			CommittedLog: map[uuid.UUID]uint64{snapshotted: 1},
+			Commits:      []Entry{{TxID: snapshotted, State: TRANSACTION_COMMITTED, Seq: 1, Command: CounterAdd(1)}},
+		})
+		if err != nil {
+			t.Fatalf("SaveSnapshot failed: %v", err)
+		}
+	}
+
+	commit(snapshotted, 1)
+	snapshot(1)
+	commit(logged, 2)
+
+	// Transaction IDs appear verbatim in plaintext gob records.
+	for _, txID := range []uuid.UUID{snapshotted, logged} {
+		for _, name := range []string{"node_1.wal", "snaps/node_1.snap"} {
+			raw, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", name, err)
+			}
+			if strings.Contains(string(raw), string(txID[:])) {
+				t.Errorf("%s holds transaction %s in plaintext", name, txID)
+			}
+		}
+	}
+
+	// After a rotation, the next snapshot and compaction re-encrypt
+	// everything with the new key.
+	current, err := keys.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	snapshot(1)
+	if err := s.Compact(0); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	s.Close()
+
+	newKey, _ := keys.Key(current)
+	onlyNew := filepath.Join(dir, "new-key")
+	if err := os.WriteFile(onlyNew, []byte(fmt.Sprintf("%s %x\n", current, newKey)), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	newKeys, err := NewFileKeyProvider(onlyNew)
+	if err != nil {
+		t.Fatalf("Failed to load key file: %v", err)
+	}
+
+	if _, err := NewStableStore(dir, 1); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Expected ErrEncrypted without a key, got %v", err)
+	}
+
+	s, err = NewStableStore(dir, 1, WithEncryption(newKeys))
+	if err != nil {
+		t.Fatalf("Failed to reopen the store with the rotated key only: %v", err)
+	}
+	if snapshot, err := s.LoadSnapshot(); err != nil || snapshot.CommittedLog[snapshotted] != 1 {
+		t.Errorf("Expected the snapshot readable with the rotated key, got %v", err)
+	}
+	var records int
+	err = s.ReplayLog(func(e Entry) error {
+		if e.TxID != snapshotted && e.TxID != logged {
+			t.Errorf("Unexpected record %+v", e)
+		}
+		records++
+		return nil
+	})
+	if err != nil || records != 4 {
+		t.Errorf("Expected the 4 records readable with the rotated key, got %d, %v", records, err)
+	}
+}
+
+func TestFileKeyProvider_RotateNeverReusesAnID(t *testing.T) {
+	// A hand-edited file whose first key was removed.
+	path := filepath.Join(t.TempDir(), "keys")
+	lines := "key-2 " + strings.Repeat("01", 32) + "\n"
+	if err := os.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("NewFileKeyProvider failed: %v", err)
+	}
+	old, _ := p.Key("key-2")
+
+	id, err := p.Rotate()
+	if err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if id == "key-2" {
+		t.Fatalf("Rotate reused the ID %s", id)
+	}
+
+	reloaded, err := NewFileKeyProvider(path)
+	if err != nil {
+		t.Fatalf("Reloading the key file failed: %v", err)
+	}
+	if key, err := reloaded.Key("key-2"); err != nil || string(key) != string(old) {
+		t.Errorf("Expected key-2 to survive the rotation, got %x, %v", key, err)
+	}
+	if current, _, _ := reloaded.CurrentKey(); current != id {
+		t.Errorf("Expected the rotated key %s to be current, got %s", id, current)
+	}
+}
@@ -1,6 +1,11 @@
 package store
 
-import "github.com/google/uuid"
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 type TransactionState uint8
 
@@ -10,9 +15,47 @@ const (
 	TRANSACTION_ABORTED   TransactionState = 3
 )
 
+func (s TransactionState) String() string {
+	switch s {
+	case TRANSACTION_PREPARED:
+		return "PREPARED"
+	case TRANSACTION_COMMITTED:
+		return "COMMITTED"
+	case TRANSACTION_ABORTED:
+		return "ABORTED"
+	}
+	return fmt.Sprintf("TransactionState(%d)", uint8(s))
+}
+
+// PROTOCOL_VERSION is stamped on every WAL record written by this build.
+// Records written before versioning was introduced decode with Version 0.
+const PROTOCOL_VERSION uint8 = 1
+
 type Entry struct {
 	TxID     uuid.UUID
 	State    TransactionState
 	SenderID int
-	Value    int
+	// Command is the state machine command of the transaction. It is only
+	// set on PREPARED and COMMITTED records.
+	Command []byte
+	// Seq is the commit sequence number, only set on COMMITTED records.
+	Seq uint64
+
+	// Participants is the full set of node IDs (coordinator included)
+	// taking part in the transaction.
+	Participants []int
+	Timestamp    time.Time
+	Version      uint8
+	// LSN is the log sequence number the store assigned to the record. It
+	// keeps increasing across compactions and restarts.
+	LSN uint64
+
+	// Sealed, on a record read from an encrypted store, holds the whole
+	// record encrypted; the other fields are then empty.
+	Sealed []byte
+
+	// Value is the new register value carried by records written before
+	// state machines were introduced. Such records are read with the
+	// equivalent Command and Value cleared.
+	Value int
 }
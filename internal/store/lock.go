@@ -0,0 +1,35 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrDataDirLocked is returned when opening a store whose data directory is
+// already in use by another store, in this process or another one.
+var ErrDataDirLocked = errors.New("data directory is locked by another process")
+
+// lockDataDir takes the exclusive lock of a node's data directory, held until
+// the returned file is closed. The lock is advisory: it only keeps out
+// stores that take it too.
+func lockDataDir(dataDir string, nodeID int) (*os.File, error) {
+	filename := filepath.Join(dataDir, fmt.Sprintf("node_%d.lock", nodeID))
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %w", ErrDataDirLocked, filename, err)
+	}
+
+	// Record the holder, for whoever finds the directory locked.
+	if err := f.Truncate(0); err == nil {
+		fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return f, nil
+}
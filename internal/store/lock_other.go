@@ -0,0 +1,11 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// flock is a no-op where flock is not available: the data directory is not
+// protected against concurrent stores.
+func flock(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive flock on f without waiting, so a second process
+// fails fast instead of blocking.
+func flock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,239 @@
+package store
+
+import (
+	"encoding/gob"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrCrashed is returned by a memory store whose disk crashed after the store
+// was opened.
+var ErrCrashed = errors.New("store crashed")
+
+// MemoryDisk is the durable medium behind memory stores. It outlives the
+// stores opened on it, so a node can be restarted on the same disk to
+// exercise recovery without touching the filesystem.
+type MemoryDisk struct {
+	mu         sync.Mutex
+	generation int
+	log        []Entry
+	snapshot   *SnapshotData
+	lsn        uint64
+}
+
+// Crash simulates a process crash: every store opened on the disk so far
+// fails with ErrCrashed from now on, while everything they wrote survives
+// for the next store opened on it.
+func (d *MemoryDisk) Crash() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.generation++
+}
+
+func NewMemoryDisk() *MemoryDisk {
+	return &MemoryDisk{}
+}
+
+type memoryStore struct {
+	disk       *MemoryDisk
+	generation int
+}
+
+// lock acquires the disk and fails if it crashed since the store was opened.
+func (s *memoryStore) lock() error {
+	s.disk.mu.Lock()
+	if s.disk.generation != s.generation {
+		s.disk.mu.Unlock()
+		return ErrCrashed
+	}
+	return nil
+}
+
+func (s *memoryStore) ReplayLog(callback func(Entry) error) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	entries := slices.Clone(s.disk.log)
+	s.disk.mu.Unlock()
+
+	for _, e := range entries {
+		if err := callback(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetTransactionState(txID uuid.UUID) (TransactionState, error) {
+	if err := s.lock(); err != nil {
+		return 0, err
+	}
+	defer s.disk.mu.Unlock()
+
+	// Default to Aborted (Presumed Abort) if not found
+	finalState := TRANSACTION_ABORTED
+	for _, e := range s.disk.log {
+		if e.TxID == txID && e.State == TRANSACTION_COMMITTED {
+			finalState = TRANSACTION_COMMITTED
+		}
+	}
+
+	return finalState, nil
+}
+
+func (s *memoryStore) SaveSnapshot(data SnapshotData) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.disk.mu.Unlock()
+
+	s.disk.snapshot = cloneSnapshot(&data)
+	return nil
+}
+
+func (s *memoryStore) LoadSnapshot() (*SnapshotData, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.disk.mu.Unlock()
+
+	if s.disk.snapshot == nil {
+		return nil, nil
+	}
+
+	// Hand out a copy, as a file store would decode a fresh one.
+	return cloneSnapshot(s.disk.snapshot), nil
+}
+
+func cloneSnapshot(data *SnapshotData) *SnapshotData {
+	clone := *data
+	clone.State = slices.Clone(data.State)
+	clone.CommittedLog = maps.Clone(data.CommittedLog)
+	clone.Commits = slices.Clone(data.Commits)
+	return &clone
+}
+
+func (s *memoryStore) RecoverLastState() (*Entry, error) {
+	if err := s.lock(); err != nil {
+		return nil, err
+	}
+	defer s.disk.mu.Unlock()
+
+	var lastState Entry
+	if len(s.disk.log) > 0 {
+		lastState = s.disk.log[len(s.disk.log)-1]
+	}
+	return &lastState, nil
+}
+
+func (s *memoryStore) Truncate(keep ...Entry) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.disk.mu.Unlock()
+
+	s.disk.log = slices.Clone(keep)
+	return nil
+}
+
+func (s *memoryStore) Compact(lsn uint64, keep ...uuid.UUID) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.disk.mu.Unlock()
+
+	s.disk.log = compactLog(s.disk.log, lsn, keep)
+	return nil
+}
+
+// Stats measures the log as the file WAL would encode it.
+func (s *memoryStore) Stats() (LogStats, error) {
+	if err := s.lock(); err != nil {
+		return LogStats{}, err
+	}
+	defer s.disk.mu.Unlock()
+
+	var size countingWriter
+	encoder := gob.NewEncoder(&size)
+	for _, e := range s.disk.log {
+		if err := encoder.Encode(e); err != nil {
+			return LogStats{}, err
+		}
+	}
+
+	return LogStats{Records: len(s.disk.log), Bytes: int64(size), LastLSN: s.disk.lsn}, nil
+}
+
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+func (s *memoryStore) WriteAborted(txID uuid.UUID, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		State:        TRANSACTION_ABORTED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *memoryStore) WriteCommited(txID uuid.UUID, cmd []byte, seq uint64, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		Command:      cmd,
+		Seq:          seq,
+		State:        TRANSACTION_COMMITTED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *memoryStore) WritePrepared(txID uuid.UUID, cmd []byte, senderID int, participants []int) error {
+	return s.writeLog(Entry{
+		TxID:         txID,
+		Command:      cmd,
+		State:        TRANSACTION_PREPARED,
+		SenderID:     senderID,
+		Participants: participants,
+	})
+}
+
+func (s *memoryStore) writeLog(entry Entry) error {
+	if err := s.lock(); err != nil {
+		return err
+	}
+	defer s.disk.mu.Unlock()
+
+	s.disk.lsn++
+	entry.LSN = s.disk.lsn
+	entry.Timestamp = time.Now()
+	entry.Version = PROTOCOL_VERSION
+	entry.Command = slices.Clone(entry.Command)
+	entry.Participants = slices.Clone(entry.Participants)
+
+	s.disk.log = append(s.disk.log, entry)
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// NewMemoryStore opens a stable store on the given in-memory disk.
+func NewMemoryStore(disk *MemoryDisk) StableStore {
+	disk.mu.Lock()
+	defer disk.mu.Unlock()
+
+	return &memoryStore{
+		disk:       disk,
+		generation: disk.generation,
+	}
+}
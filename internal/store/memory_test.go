@@ -0,0 +1,30 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryStore_CrashFailsOpenStores(t *testing.T) {
+	disk := NewMemoryDisk()
+	s := NewMemoryStore(disk)
+
+	txID := uuid.New()
+	if err := s.WritePrepared(txID, CounterSet(1), 0, []int{0, 1}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	disk.Crash()
+	if err := s.WriteCommited(txID, CounterSet(1), 1, 0, []int{0, 1}); err != ErrCrashed {
+		t.Fatalf("Expected ErrCrashed after crash, got %v", err)
+	}
+
+	last, err := NewMemoryStore(disk).RecoverLastState()
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if last.TxID != txID || last.State != TRANSACTION_PREPARED {
+		t.Errorf("Durable record lost across crash: %+v", last)
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"slices"
+
+	"github.com/google/uuid"
+)
+
+// Before state machines were introduced, nodes replicated a single integer
+// register. Their records carry the new value of the register in Value
+// instead of a command, and their snapshot is a single gob value of a
+// baselineSnapshot rather than a snapshot stream. Both are migrated on read;
+// the next snapshot and compaction rewrite them in the current format.
+
+// upgrade turns a record written before state machines into one setting the
+// Counter register to the value it carries.
+func (e Entry) upgrade() Entry {
+	if e.Version == 0 && e.Command == nil && e.State != TRANSACTION_ABORTED {
+		e.Command = CounterSet(e.Value)
+		e.Value = 0
+	}
+	return e
+}
+
+type baselineSnapshot struct {
+	State        int
+	CommittedLog map[uuid.UUID]bool
+}
+
+// readSnapshotFile reads a snapshot file, in the current format or in the
+// one written before state machines.
+func readSnapshotFile(r *bufio.Reader, sealer *sealer) (*SnapshotData, error) {
+	if prefix, _ := r.Peek(len(snapshotMagic)); bytes.Equal(prefix, snapshotMagic) {
+		return readSnapshot(r, sealer)
+	}
+
+	var baseline baselineSnapshot
+	if err := gob.NewDecoder(r).Decode(&baseline); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	return baseline.upgrade(), nil
+}
+
+// upgrade converts the snapshot to the Counter state machine. The baseline
+// did not order commits, so committed transactions get sequence numbers in
+// the order of their IDs, the same on every node holding the same history.
+func (b *baselineSnapshot) upgrade() *SnapshotData {
+	txIDs := make([]uuid.UUID, 0, len(b.CommittedLog))
+	for txID, committed := range b.CommittedLog {
+		if committed {
+			txIDs = append(txIDs, txID)
+		}
+	}
+	slices.SortFunc(txIDs, func(a, b uuid.UUID) int { return bytes.Compare(a[:], b[:]) })
+
+	data := &SnapshotData{
+		State:        EncodeCounterState(b.State),
+		CommittedLog: make(map[uuid.UUID]uint64, len(txIDs)),
+	}
+	for _, txID := range txIDs {
+		data.Seq++
+		data.CommittedLog[txID] = data.Seq
+		data.HistoryHash = sha256.Sum256(append(data.HistoryHash[:], txID[:]...))
+	}
+	return data
+}
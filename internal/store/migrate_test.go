@@ -0,0 +1,113 @@
+package store
+
+import (
+	"encoding/gob"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// baselineEntry is a WAL record as written before state machines were
+// introduced.
+type baselineEntry struct {
+	TxID     uuid.UUID
+	State    TransactionState
+	SenderID int
+	Value    int
+}
+
+func TestStableStore_LoadsBaselineWALAndSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(dir+"/snaps", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotted := []uuid.UUID{uuid.New(), uuid.New()}
+	snap, err := os.Create(SnapshotPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewEncoder(snap).Encode(baselineSnapshot{
+		State:        5,
+		CommittedLog: map[uuid.UUID]bool{snapshotted[0]: true, snapshotted[1]: true},
+	})
+	snap.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, aborted := uuid.New(), uuid.New()
+	wal, err := os.Create(WALPath(dir, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := gob.NewEncoder(wal)
+	for _, e := range []baselineEntry{
+		{TxID: committed, State: TRANSACTION_PREPARED, SenderID: 1, Value: 8},
+		{TxID: committed, State: TRANSACTION_COMMITTED, SenderID: 1, Value: 8},
+		{TxID: aborted, State: TRANSACTION_PREPARED, SenderID: 2, Value: 10},
+		{TxID: aborted, State: TRANSACTION_ABORTED},
+	} {
+		if err := encoder.Encode(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+
+	s, err := NewStableStore(dir, 1)
+	if err != nil {
+		t.Fatalf("NewStableStore failed: %v", err)
+	}
+	defer s.Close()
+
+	snapshot, err := s.LoadSnapshot()
+	if err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	counter := NewCounter(0)
+	vs := NewVolatileStore(counter)
+	if err := vs.Recover(snapshot); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	if counter.Value() != 5 || snapshot.Seq != 2 {
+		t.Errorf("Expected the baseline snapshot at 5 after 2 commits, got %d after %d", counter.Value(), snapshot.Seq)
+	}
+	for _, txID := range snapshotted {
+		if !vs.IsCommitted(txID) {
+			t.Errorf("Expected %s committed", txID)
+		}
+	}
+
+	var states []TransactionState
+	err = s.ReplayLog(func(e Entry) error {
+		states = append(states, e.State)
+		if e.State == TRANSACTION_ABORTED {
+			if e.Command != nil {
+				t.Errorf("Expected no command on an ABORTED record, got %v", e.Command)
+			}
+			return nil
+		}
+		if e.Value != 0 {
+			t.Errorf("Expected Value cleared once migrated, got %d", e.Value)
+		}
+		if e.State == TRANSACTION_COMMITTED {
+			return vs.Replay(e)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReplayLog failed: %v", err)
+	}
+	if len(states) != 4 {
+		t.Fatalf("Expected 4 records, got %v", states)
+	}
+	if counter.Value() != 8 || !vs.IsCommitted(committed) || vs.IsCommitted(aborted) {
+		t.Errorf("Expected the baseline commit to set the register to 8, got %d", counter.Value())
+	}
+
+	state, err := s.GetTransactionState(committed)
+	if err != nil || state != TRANSACTION_COMMITTED {
+		t.Errorf("Expected %s COMMITTED, got %v (%v)", committed, state, err)
+	}
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Snapshots are written as a stream: the magic, a flags byte, then chunks.
+// Each chunk is its length (uint32), its payload and the CRC-32 of the
+// payload; a zero length ends the stream. Concatenated, the payloads are a
+// flate-compressed gob stream of a snapshotHeader followed by the state in
+// pieces, the committed transactions in batches and the commits in batches,
+// so neither side ever holds the whole encoded snapshot. When the snapshot is
+// encrypted, every payload is sealed on its own.
+var snapshotMagic = []byte("2PCSNAP\x01")
+
+const (
+	snapshotEncrypted byte = 1 << iota
+)
+
+const (
+	// SnapshotChunkSize is the size of the compressed data in a chunk.
+	SnapshotChunkSize = 64 << 10
+	snapshotPieceSize = 64 << 10
+	snapshotBatchSize = 1024
+)
+
+var ErrSnapshotCorrupted = errors.New("snapshot is corrupted")
+
+type snapshotHeader struct {
+	Seq         uint64
+	LSN         uint64
+	Watermark   uint64
+	HistoryHash [sha256.Size]byte
+	StateSize   int
+	Committed   int
+	Commits     int
+}
+
+type committedTx struct {
+	TxID uuid.UUID
+	Seq  uint64
+}
+
+// WriteSnapshot streams data to w in the chunked, compressed snapshot format.
+func WriteSnapshot(w io.Writer, data *SnapshotData) error {
+	return writeSnapshot(w, data, nil)
+}
+
+// ReadSnapshot reads a snapshot streamed by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*SnapshotData, error) {
+	return readSnapshot(r, nil)
+}
+
+func writeSnapshot(w io.Writer, data *SnapshotData, sealer *sealer) error {
+	var flags byte
+	if sealer != nil {
+		flags |= snapshotEncrypted
+	}
+	if _, err := w.Write(append(bytes.Clone(snapshotMagic), flags)); err != nil {
+		return err
+	}
+
+	chunks := &chunkWriter{w: w, sealer: sealer}
+	compressor, err := flate.NewWriter(chunks, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	encoder := gob.NewEncoder(compressor)
+
+	err = encoder.Encode(snapshotHeader{
+		Seq:         data.Seq,
+		LSN:         data.LSN,
+		Watermark:   data.Watermark,
+		HistoryHash: data.HistoryHash,
+		StateSize:   len(data.State),
+		Committed:   len(data.CommittedLog),
+		Commits:     len(data.Commits),
+	})
+	if err != nil {
+		return err
+	}
+
+	for state := data.State; len(state) > 0; {
+		n := min(len(state), snapshotPieceSize)
+		if err := encoder.Encode(state[:n]); err != nil {
+			return err
+		}
+		state = state[n:]
+	}
+
+	batch := make([]committedTx, 0, snapshotBatchSize)
+	for txID, seq := range data.CommittedLog {
+		batch = append(batch, committedTx{TxID: txID, Seq: seq})
+		if len(batch) == snapshotBatchSize {
+			if err := encoder.Encode(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := encoder.Encode(batch); err != nil {
+			return err
+		}
+	}
+
+	for commits := data.Commits; len(commits) > 0; {
+		n := min(len(commits), snapshotBatchSize)
+		if err := encoder.Encode(commits[:n]); err != nil {
+			return err
+		}
+		commits = commits[n:]
+	}
+
+	if err := compressor.Close(); err != nil {
+		return err
+	}
+	return chunks.Close()
+}
+
+func readSnapshot(r io.Reader, sealer *sealer) (*SnapshotData, error) {
+	prefix := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	if !bytes.HasPrefix(prefix, snapshotMagic) {
+		return nil, fmt.Errorf("%w: not a snapshot stream", ErrSnapshotCorrupted)
+	}
+
+	encrypted := prefix[len(snapshotMagic)]&snapshotEncrypted != 0
+	if encrypted && sealer == nil {
+		return nil, ErrEncrypted
+	}
+	if !encrypted {
+		sealer = nil
+	}
+
+	decompressor := flate.NewReader(&chunkReader{r: r, sealer: sealer})
+	defer decompressor.Close()
+	decoder := gob.NewDecoder(decompressor)
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return nil, err
+	}
+
+	if header.StateSize < 0 || header.Committed < 0 || header.Commits < 0 {
+		return nil, fmt.Errorf("%w: negative size in header", ErrSnapshotCorrupted)
+	}
+
+	// The sizes of the header are not trusted for allocations: a corrupted
+	// header must not reserve more than what the stream actually holds.
+	data := &SnapshotData{
+		Seq:          header.Seq,
+		LSN:          header.LSN,
+		Watermark:    header.Watermark,
+		HistoryHash:  header.HistoryHash,
+		State:        make([]byte, 0, min(header.StateSize, snapshotPieceSize)),
+		CommittedLog: make(map[uuid.UUID]uint64, min(header.Committed, snapshotBatchSize)),
+		Commits:      make([]Entry, 0, min(header.Commits, snapshotBatchSize)),
+	}
+
+	for len(data.State) < header.StateSize {
+		var piece []byte
+		if err := decoder.Decode(&piece); err != nil {
+			return nil, err
+		}
+		if len(piece) == 0 || len(data.State)+len(piece) > header.StateSize {
+			return nil, fmt.Errorf("%w: state larger than its header", ErrSnapshotCorrupted)
+		}
+		data.State = append(data.State, piece...)
+	}
+
+	for len(data.CommittedLog) < header.Committed {
+		var batch []committedTx
+		if err := decoder.Decode(&batch); err != nil {
+			return nil, err
+		}
+		for _, tx := range batch {
+			data.CommittedLog[tx.TxID] = tx.Seq
+		}
+	}
+
+	for len(data.Commits) < header.Commits {
+		var batch []Entry
+		if err := decoder.Decode(&batch); err != nil {
+			return nil, err
+		}
+		data.Commits = append(data.Commits, batch...)
+	}
+
+	return data, nil
+}
+
+// chunkWriter cuts what is written to it into chunks of SnapshotChunkSize
+// bytes. Close writes the last, partial chunk and the end of the stream.
+type chunkWriter struct {
+	w      io.Writer
+	sealer *sealer
+	buf    []byte
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= SnapshotChunkSize {
+		if err := c.writeChunk(c.buf[:SnapshotChunkSize]); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[SnapshotChunkSize:]
+	}
+	return len(p), nil
+}
+
+func (c *chunkWriter) Close() error {
+	if len(c.buf) > 0 {
+		if err := c.writeChunk(c.buf); err != nil {
+			return err
+		}
+		c.buf = nil
+	}
+	return binary.Write(c.w, binary.BigEndian, uint32(0))
+}
+
+func (c *chunkWriter) writeChunk(chunk []byte) error {
+	payload := chunk
+	if c.sealer != nil {
+		var err error
+		if payload, err = c.sealer.seal(chunk); err != nil {
+			return err
+		}
+	}
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+	_, err := c.w.Write(frame)
+	return err
+}
+
+// chunkReader reads back the concatenated payloads of the chunks, checking
+// each one.
+type chunkReader struct {
+	r      io.Reader
+	sealer *sealer
+	buf    []byte
+	done   bool
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkReader) readChunk() error {
+	var size uint32
+	if err := binary.Read(c.r, binary.BigEndian, &size); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	if size == 0 {
+		c.done = true
+		return nil
+	}
+	if size > 2*SnapshotChunkSize {
+		return fmt.Errorf("%w: chunk of %d bytes", ErrSnapshotCorrupted, size)
+	}
+
+	payload := make([]byte, size)
+	var sum uint32
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	if err := binary.Read(c.r, binary.BigEndian, &sum); err != nil {
+		return fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return fmt.Errorf("%w: chunk checksum mismatch", ErrSnapshotCorrupted)
+	}
+
+	if c.sealer != nil {
+		var err error
+		if payload, err = c.sealer.open(payload); err != nil {
+			return err
+		}
+	}
+	c.buf = payload
+	return nil
+}
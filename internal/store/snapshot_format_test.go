@@ -0,0 +1,80 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/uuid"
+)
+
+func TestSnapshotFormat_CompressedChunkedStream(t *testing.T) {
+	data := &SnapshotData{
+		State:        []byte(strings.Repeat("ledger entry;", 40000)),
+		Seq:          3000,
+		LSN:          6000,
+		Watermark:    2990,
+		CommittedLog: make(map[uuid.UUID]uint64),
+	}
+	for seq := uint64(2991); seq <= data.Seq; seq++ {
+		txID := uuid.New()
+		data.CommittedLog[txID] = seq
+		data.Commits = append(data.Commits, Entry{TxID: txID, Seq: seq, State: TRANSACTION_COMMITTED, Command: CounterAdd(1)})
+	}
+	for len(data.CommittedLog) < 3000 {
+		data.CommittedLog[uuid.New()] = uint64(len(data.CommittedLog))
+	}
+
+	var stream bytes.Buffer
+	if err := WriteSnapshot(&stream, data); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if stream.Len() >= len(data.State)/4 {
+		t.Errorf("Snapshot was not compressed: %d bytes for a %d bytes state", stream.Len(), len(data.State))
+	}
+
+	// Reading never needs more than what the reader hands out.
+	read, err := ReadSnapshot(iotest.OneByteReader(bytes.NewReader(stream.Bytes())))
+	if err != nil {
+		t.Fatalf("ReadSnapshot failed: %v", err)
+	}
+	if !reflect.DeepEqual(read, data) {
+		t.Errorf("Snapshot changed through the stream")
+	}
+
+	corrupted := bytes.Clone(stream.Bytes())
+	corrupted[len(corrupted)/2] ^= 0xff
+	if _, err := ReadSnapshot(bytes.NewReader(corrupted)); !errors.Is(err, ErrSnapshotCorrupted) {
+		t.Errorf("Expected ErrSnapshotCorrupted, got %v", err)
+	}
+}
+
+func TestReadSnapshot_RejectsSizesBeyondTheStream(t *testing.T) {
+	for name, header := range map[string]snapshotHeader{
+		"huge state":     {StateSize: 1 << 50},
+		"negative count": {Commits: -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var stream bytes.Buffer
+			stream.Write(append(bytes.Clone(snapshotMagic), 0))
+			chunks := &chunkWriter{w: &stream}
+			compressor, _ := flate.NewWriter(chunks, flate.DefaultCompression)
+			encoder := gob.NewEncoder(compressor)
+			encoder.Encode(header)
+			encoder.Encode([]byte("tiny"))
+			compressor.Close()
+			chunks.Close()
+
+			// Reading fails on what the stream holds, without first
+			// reserving what the header claims.
+			if _, err := ReadSnapshot(bytes.NewReader(stream.Bytes())); err == nil {
+				t.Error("Expected the snapshot to be rejected")
+			}
+		})
+	}
+}
@@ -1,38 +1,88 @@
 package store
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type StableStore interface {
-	WritePrepared(txID uuid.UUID, value, senderID int) error
-	WriteCommited(txID uuid.UUID, value, senderID int) error
-	WriteAborted(txID uuid.UUID, senderID int) error
-	SaveSnapshot(state int, history map[uuid.UUID]bool) error
+	WritePrepared(txID uuid.UUID, cmd []byte, senderID int, participants []int) error
+	WriteCommited(txID uuid.UUID, cmd []byte, seq uint64, senderID int, participants []int) error
+	WriteAborted(txID uuid.UUID, senderID int, participants []int) error
+	SaveSnapshot(data SnapshotData) error
 	LoadSnapshot() (*SnapshotData, error)
 	RecoverLastState() (*Entry, error)
-	Truncate() error
+	Truncate(keep ...Entry) error
+	// Compact drops the records up to lsn, covered by a snapshot, except
+	// the PREPARED records of the keep transactions, which are rewritten as
+	// they were ahead of the records that follow. Records written after lsn
+	// are preserved, so the snapshot need not stop writers; they only wait
+	// for the rewrite itself.
+	Compact(lsn uint64, keep ...uuid.UUID) error
+	Stats() (LogStats, error)
 	GetTransactionState(txID uuid.UUID) (TransactionState, error)
 	ReplayLog(callback func(Entry) error) error
 	Close() error
 }
 
+// LogStats describes the current size of a WAL.
+type LogStats struct {
+	Records int   `json:"records"`
+	Bytes   int64 `json:"bytes"`
+	// LastLSN is the log sequence number of the last record written, or of
+	// the last record covered by the snapshot if none was written since.
+	LastLSN uint64 `json:"last_lsn"`
+}
+
 type SnapshotData struct {
-	State        int
-	CommittedLog map[uuid.UUID]bool
+	// State is the state machine snapshot.
+	State []byte
+	// LSN is the log sequence number of the last WAL record the snapshot
+	// covers.
+	LSN uint64
+	// Seq is the commit sequence number of the last transaction included
+	// in State.
+	Seq uint64
+	// CommittedLog maps committed transactions to their commit sequence
+	// numbers. Transactions at or below Watermark are pruned from it.
+	CommittedLog map[uuid.UUID]uint64
+	// Commits holds the COMMITTED record of every transaction above
+	// Watermark in commit order, so the node can replay them to peers that
+	// missed some.
+	Commits []Entry
+	// Watermark is the commit sequence number every node of the cluster is
+	// known to have reached.
+	Watermark uint64
+	// HistoryHash chains the IDs of all committed transactions, in commit
+	// order.
+	HistoryHash [sha256.Size]byte
 }
 
 type stableStore struct {
 	mu      sync.Mutex
 	nodeID  int
+	dataDir string
+	lock    *os.File
 	file    *os.File
 	encoder *gob.Encoder
+	sealer  *sealer
+	// lsn is the last log sequence number assigned, and records the number
+	// of records in the log.
+	lsn     uint64
+	records int
+	// onSync observes how long writing each record took.
+	onSync func(time.Duration)
 }
 
 func (s *stableStore) ReplayLog(callback func(Entry) error) error {
@@ -44,28 +94,46 @@ func (s *stableStore) ReplayLog(callback func(Entry) error) error {
 		return err
 	}
 
-	decoder := gob.NewDecoder(s.file)
+	return s.readLog(s.file, callback)
+}
+
+// readLog decodes the records of a log, opening the encrypted ones, up to
+// its end.
+func (s *stableStore) readLog(r io.Reader, callback func(Entry) error) error {
+	decoder := gob.NewDecoder(r)
 	for {
 		var e Entry
 		if err := decoder.Decode(&e); err != nil {
 			if err == io.EOF {
-				break
+				return nil
 			}
 			return err
 		}
+
+		e, err := s.sealer.openEntry(e)
+		if err != nil {
+			return err
+		}
 		if err := callback(e); err != nil {
 			return err
 		}
 	}
-	return nil
+}
+
+// writeRecord encodes a record, sealed if the store is encrypted.
+func (s *stableStore) writeRecord(encoder *gob.Encoder, e Entry) error {
+	record, err := s.sealer.sealEntry(e)
+	if err != nil {
+		return err
+	}
+	return encoder.Encode(record)
 }
 
 func (s *stableStore) GetTransactionState(txID uuid.UUID) (TransactionState, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	filename := fmt.Sprintf("./logs/node_%d.wal", s.nodeID)
-	f, err := os.Open(filename)
+	f, err := os.Open(s.walPath())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return TRANSACTION_ABORTED, nil
@@ -74,54 +142,60 @@ func (s *stableStore) GetTransactionState(txID uuid.UUID) (TransactionState, err
 	}
 	defer f.Close()
 
-	decoder := gob.NewDecoder(f)
 	// Default to Aborted (Presumed Abort) if not found
 	finalState := TRANSACTION_ABORTED
 
-	for {
-		var e Entry
-		if err := decoder.Decode(&e); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return 0, err
-		}
-
+	err = s.readLog(f, func(e Entry) error {
 		if e.TxID == txID {
 			if e.State == TRANSACTION_COMMITTED {
 				finalState = TRANSACTION_COMMITTED
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
 	return finalState, nil
 }
 
-func (s *stableStore) SaveSnapshot(state int, history map[uuid.UUID]bool) error {
+func (s *stableStore) SaveSnapshot(data SnapshotData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	filename := fmt.Sprintf("logs/snaps/node_%d.snap", s.nodeID)
-	f, err := os.Create(filename)
+	// The snapshot is streamed to a temporary file renamed over the previous
+	// one, which a crash midway leaves intact.
+	filename := s.snapshotPath()
+	f, err := os.Create(filename + ".tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	data := SnapshotData{
-		State:        state,
-		CommittedLog: history,
+	w := bufio.NewWriter(f)
+	err = writeSnapshot(w, &data, s.sealer)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename + ".tmp")
+		return err
 	}
 
-	return gob.NewEncoder(f).Encode(data)
+	return os.Rename(filename+".tmp", filename)
 }
 
 func (s *stableStore) LoadSnapshot() (*SnapshotData, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	filename := fmt.Sprintf("logs/snaps/node_%d.snap", s.nodeID)
-	f, err := os.Open(filename)
+	f, err := os.Open(s.snapshotPath())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -130,12 +204,7 @@ func (s *stableStore) LoadSnapshot() (*SnapshotData, error) {
 	}
 	defer f.Close()
 
-	var data SnapshotData
-	if err := gob.NewDecoder(f).Decode(&data); err != nil {
-		return nil, err
-	}
-
-	return &data, nil
+	return readSnapshotFile(bufio.NewReader(f), s.sealer)
 }
 
 func (s *stableStore) RecoverLastState() (*Entry, error) {
@@ -153,36 +222,146 @@ func (s *stableStore) RecoverLastState() (*Entry, error) {
 			}
 			return &lastState, fmt.Errorf("potential corruption at end of log: %w", err)
 		}
+		current, err := s.sealer.openEntry(current)
+		if err != nil {
+			return &lastState, err
+		}
 		lastState = current
 	}
 
 	return &lastState, nil
 }
 
-func (s *stableStore) Truncate() error {
-	return s.file.Truncate(0)
+// Truncate empties the WAL and rewrites the given entries, as they were, at
+// the start of the new log. It is used to compact the log after a snapshot
+// without losing the records of transactions that are still in doubt.
+func (s *stableStore) Truncate(keep ...Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+
+	// The previous encoder already sent its type information to the
+	// truncated part of the file, so the new log needs a fresh one.
+	s.encoder = gob.NewEncoder(s.file)
+	for _, e := range keep {
+		if err := s.writeRecord(s.encoder, e); err != nil {
+			return err
+		}
+	}
+	s.records = len(keep)
+
+	return s.file.Sync()
 }
 
-func (s *stableStore) WriteAborted(txID uuid.UUID, senderID int) error {
+// Compact writes the new log to a temporary file and renames it over the
+// WAL, so a crash midway leaves the previous log intact. Every record is
+// sealed anew, with the current key if the store is encrypted.
+func (s *stableStore) Compact(lsn uint64, keep ...uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	var log []Entry
+	err := s.readLog(s.file, func(e Entry) error {
+		log = append(log, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log = compactLog(log, lsn, keep)
+
+	filename := s.walPath()
+	f, err := os.OpenFile(filename+".tmp", os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	encoder := gob.NewEncoder(f)
+	err = func() error {
+		for _, e := range log {
+			if err := s.writeRecord(encoder, e); err != nil {
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return os.Rename(filename+".tmp", filename)
+	}()
+	if err != nil {
+		f.Close()
+		os.Remove(filename + ".tmp")
+		return err
+	}
+
+	s.file.Close()
+	s.file, s.encoder = f, encoder
+	s.records = len(log)
+	return nil
+}
+
+// compactLog returns the records of log left once those up to lsn are
+// dropped: the PREPARED records of the keep transactions, with the LSN and
+// version they were written with, then the records after lsn.
+func compactLog(log []Entry, lsn uint64, keep []uuid.UUID) []Entry {
+	var kept, rest []Entry
+	for _, e := range log {
+		switch {
+		case e.LSN > lsn:
+			rest = append(rest, e)
+		case e.State == TRANSACTION_PREPARED && slices.Contains(keep, e.TxID):
+			kept = append(kept, e)
+		}
+	}
+	return append(kept, rest...)
+}
+
+func (s *stableStore) Stats() (LogStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return LogStats{}, err
+	}
+
+	return LogStats{Records: s.records, Bytes: info.Size(), LastLSN: s.lsn}, nil
+}
+
+func (s *stableStore) WriteAborted(txID uuid.UUID, senderID int, participants []int) error {
 	return s.writeLog(Entry{
-		TxID:  txID,
-		State: TRANSACTION_ABORTED,
+		TxID:         txID,
+		State:        TRANSACTION_ABORTED,
+		SenderID:     senderID,
+		Participants: participants,
 	})
 }
 
-func (s *stableStore) WriteCommited(txID uuid.UUID, value, senderID int) error {
+func (s *stableStore) WriteCommited(txID uuid.UUID, cmd []byte, seq uint64, senderID int, participants []int) error {
 	return s.writeLog(Entry{
-		TxID:  txID,
-		Value: value,
-		State: TRANSACTION_COMMITTED,
+		TxID:         txID,
+		Command:      cmd,
+		Seq:          seq,
+		State:        TRANSACTION_COMMITTED,
+		SenderID:     senderID,
+		Participants: participants,
 	})
 }
 
-func (s *stableStore) WritePrepared(txID uuid.UUID, value, senderID int) error {
+func (s *stableStore) WritePrepared(txID uuid.UUID, cmd []byte, senderID int, participants []int) error {
 	return s.writeLog(Entry{
-		TxID:  txID,
-		Value: value,
-		State: TRANSACTION_PREPARED,
+		TxID:         txID,
+		Command:      cmd,
+		State:        TRANSACTION_PREPARED,
+		SenderID:     senderID,
+		Participants: participants,
 	})
 }
 
@@ -190,36 +369,113 @@ func (s *stableStore) writeLog(entry Entry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.encoder.Encode(entry); err != nil {
+	s.lsn++
+	entry.LSN = s.lsn
+	entry.Timestamp = time.Now()
+	entry.Version = PROTOCOL_VERSION
+
+	if err := s.writeRecord(s.encoder, entry); err != nil {
 		return err
 	}
+	s.records++
 
-	return s.file.Sync()
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	if s.onSync != nil {
+		s.onSync(time.Since(entry.Timestamp))
+	}
+	return nil
 }
 
 func (s *stableStore) Close() error {
-	return s.file.Close()
+	return errors.Join(s.file.Close(), s.lock.Close())
+}
+
+func (s *stableStore) walPath() string {
+	return WALPath(s.dataDir, s.nodeID)
 }
 
-func NewStableStore(nodeID int) (StableStore, error) {
-	if err := os.MkdirAll("./logs", 0755); err != nil {
+func (s *stableStore) snapshotPath() string {
+	return SnapshotPath(s.dataDir, s.nodeID)
+}
+
+// WALPath is where the file WAL of a node keeps its log.
+func WALPath(dataDir string, nodeID int) string {
+	return filepath.Join(dataDir, fmt.Sprintf("node_%d.wal", nodeID))
+}
+
+// SnapshotPath is where the file WAL of a node keeps its snapshot.
+func SnapshotPath(dataDir string, nodeID int) string {
+	return filepath.Join(dataDir, "snaps", fmt.Sprintf("node_%d.snap", nodeID))
+}
+
+// WithSyncObserver makes the file WAL report how long writing and syncing
+// each record took. Other stores ignore it.
+func WithSyncObserver(observe func(time.Duration)) StoreOption {
+	return func(o *storeOptions) {
+		o.onSync = observe
+	}
+}
+
+// NewStableStore opens (or creates) the gob file WAL of a node in dataDir,
+// and locks the directory so no other store can open it meanwhile.
+func NewStableStore(dataDir string, nodeID int, opts ...StoreOption) (StableStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create log directory: %w", err)
 	}
 
-	if err := os.MkdirAll("./logs/snaps", 0755); err != nil {
+	if err := os.MkdirAll(filepath.Join(dataDir, "snaps"), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create snaps directory: %w", err)
 	}
 
-	filename := fmt.Sprintf("./logs/node_%d.wal", nodeID)
-
-	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	lock, err := lockDataDir(dataDir, nodeID)
 	if err != nil {
 		return nil, err
 	}
 
-	return &stableStore{
-		file:    f,
-		encoder: gob.NewEncoder(f),
+	s := &stableStore{
 		nodeID:  nodeID,
-	}, nil
+		dataDir: dataDir,
+		lock:    lock,
+		sealer:  newSealer(opts),
+		onSync:  newStoreOptions(opts).onSync,
+	}
+
+	f, err := os.OpenFile(s.walPath(), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.file, s.encoder = f, gob.NewEncoder(f)
+
+	if err := s.scan(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// scan counts the records of the log and resumes log sequence numbers after
+// the last one written, by the log or the snapshot. A corrupted tail stops
+// the count; it is reported by recovery.
+func (s *stableStore) scan() error {
+	s.readLog(s.file, func(e Entry) error {
+		s.records++
+		s.lsn = max(s.lsn, e.LSN)
+		return nil
+	})
+
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return err
+	}
+
+	snapshot, err := s.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot != nil {
+		s.lsn = max(s.lsn, snapshot.LSN)
+	}
+	return nil
 }
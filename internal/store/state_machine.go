@@ -0,0 +1,188 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// StateMachine is the application state a node drives through 2PC. Commands
+// are opaque to the node: they are validated while the transaction holds the
+// lock, written to the WAL, and applied once the transaction commits.
+//
+// The volatile store serialises all calls it makes; implementations only need
+// their own locking if the application reads them concurrently.
+type StateMachine interface {
+	// Validate reports whether cmd can be applied to the current state. It
+	// runs during prepare, and a non-nil error makes the node vote no.
+	Validate(cmd []byte) error
+	// Apply applies a command that was validated and then committed.
+	Apply(cmd []byte) error
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+}
+
+var (
+	// ErrPreconditionFailed is returned when a command's precondition does
+	// not hold on the node's own state.
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	errBadCounterCommand = errors.New("malformed counter command")
+)
+
+type CounterOp uint8
+
+const (
+	COUNTER_ADD             CounterOp = 1
+	COUNTER_SET             CounterOp = 2
+	COUNTER_COMPARE_AND_SET CounterOp = 3
+)
+
+// CounterCommand is an operation on the Counter. Each node applies it to its
+// own register, so a node whose state diverged is detected by preconditions
+// instead of being silently overwritten.
+type CounterCommand struct {
+	Op    CounterOp
+	Value int
+	// Expected is the value the register must hold for a
+	// COUNTER_COMPARE_AND_SET to apply.
+	Expected int
+}
+
+// Counter is the default state machine: a single integer register.
+type Counter struct {
+	mu    sync.RWMutex
+	value int
+}
+
+func (c *Counter) Value() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.value
+}
+
+// Preview returns the value the register would hold after applying cmd,
+// or an error if cmd is malformed or its precondition does not hold.
+func (c *Counter) Preview(cmd []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.preview(cmd)
+}
+
+func (c *Counter) preview(cmd []byte) (int, error) {
+	op, err := DecodeCounterCommand(cmd)
+	if err != nil {
+		return 0, err
+	}
+
+	switch op.Op {
+	case COUNTER_ADD:
+		return c.value + op.Value, nil
+	case COUNTER_SET:
+		return op.Value, nil
+	case COUNTER_COMPARE_AND_SET:
+		if c.value != op.Expected {
+			return 0, fmt.Errorf("%w: expected %d, found %d", ErrPreconditionFailed, op.Expected, c.value)
+		}
+		return op.Value, nil
+	}
+
+	return 0, errBadCounterCommand
+}
+
+func (c *Counter) Validate(cmd []byte) error {
+	_, err := c.Preview(cmd)
+	return err
+}
+
+func (c *Counter) Apply(cmd []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, err := c.preview(cmd)
+	if err != nil {
+		return err
+	}
+	c.value = value
+	return nil
+}
+
+func (c *Counter) Snapshot() ([]byte, error) {
+	return EncodeCounterState(c.Value()), nil
+}
+
+func (c *Counter) Restore(snapshot []byte) error {
+	value, err := DecodeCounterState(snapshot)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = value
+	return nil
+}
+
+// EncodeCounterState returns the snapshot of a Counter holding value, as
+// expected by conditional transactions.
+func EncodeCounterState(value int) []byte {
+	return binary.AppendVarint(nil, int64(value))
+}
+
+// DecodeCounterState returns the value held by a Counter snapshot. An empty
+// snapshot is a zero register.
+func DecodeCounterState(snapshot []byte) (int, error) {
+	if len(snapshot) == 0 {
+		return 0, nil
+	}
+
+	value, n := binary.Varint(snapshot)
+	if n != len(snapshot) {
+		return 0, errors.New("malformed counter snapshot")
+	}
+	return int(value), nil
+}
+
+// CounterAdd returns the command adding delta to the register.
+func CounterAdd(delta int) []byte {
+	return EncodeCounterCommand(CounterCommand{Op: COUNTER_ADD, Value: delta})
+}
+
+// CounterSet returns the command setting the register to value.
+func CounterSet(value int) []byte {
+	return EncodeCounterCommand(CounterCommand{Op: COUNTER_SET, Value: value})
+}
+
+// CounterCompareAndSet returns the command setting the register to value
+// only if it still holds expected.
+func CounterCompareAndSet(expected, value int) []byte {
+	return EncodeCounterCommand(CounterCommand{Op: COUNTER_COMPARE_AND_SET, Value: value, Expected: expected})
+}
+
+func EncodeCounterCommand(cmd CounterCommand) []byte {
+	buf := []byte{byte(cmd.Op)}
+	buf = binary.AppendVarint(buf, int64(cmd.Value))
+	return binary.AppendVarint(buf, int64(cmd.Expected))
+}
+
+func DecodeCounterCommand(cmd []byte) (CounterCommand, error) {
+	if len(cmd) == 0 {
+		return CounterCommand{}, errBadCounterCommand
+	}
+
+	value, n := binary.Varint(cmd[1:])
+	if n <= 0 {
+		return CounterCommand{}, errBadCounterCommand
+	}
+	expected, m := binary.Varint(cmd[1+n:])
+	if m <= 0 || 1+n+m != len(cmd) {
+		return CounterCommand{}, errBadCounterCommand
+	}
+
+	return CounterCommand{Op: CounterOp(cmd[0]), Value: int(value), Expected: int(expected)}, nil
+}
+
+func NewCounter(value int) *Counter {
+	return &Counter{value: value}
+}
@@ -1,122 +1,453 @@
 package store
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"maps"
+	"slices"
 	"sync"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrLocked           = errors.New("node is locked by another transaction")
+	ErrAlreadyCommitted = errors.New("transaction already committed")
+	ErrVersionPruned    = errors.New("version was garbage collected")
+	ErrVersionNotFound  = errors.New("version not committed yet")
+	ErrCommitsPruned    = errors.New("commits were pruned from the history")
+)
+
+// Fingerprint summarises the committed state of a store. Two stores that
+// applied the same transactions in the same order have equal fingerprints.
+type Fingerprint struct {
+	Seq         uint64
+	LastTxID    uuid.UUID
+	StateHash   [sha256.Size]byte
+	HistoryHash [sha256.Size]byte
+}
+
+// Version is the state machine snapshot produced by a committed transaction,
+// tagged with the commit sequence number of that transaction.
+type Version struct {
+	Seq   uint64
+	TxID  uuid.UUID
+	State []byte
+}
+
 type VolatileStore interface {
-	Prepare(txID uuid.UUID, newState int) error
-	Commit(txID uuid.UUID) error
+	Prepare(txID uuid.UUID, cmd []byte) error
+	PrepareIf(txID uuid.UUID, cmd, expected []byte) error
+	Reacquire(txID uuid.UUID, cmd []byte)
+	Commit(record Entry) error
 	Abort(txID uuid.UUID) error
-	Recover(state int, commitedLog map[uuid.UUID]bool)
-	State() int
-	GetCommittedHistory() map[uuid.UUID]bool
+	Recover(snapshot *SnapshotData) error
+	Replay(record Entry) error
+	Snapshot() ([]byte, error)
+	Fingerprint() (Fingerprint, error)
+	// Commits returns the COMMITTED records following commit sequence
+	// number after, in order.
+	Commits(after uint64) ([]Entry, error)
+	// Checkpoint returns the current state, sequence number and committed
+	// history, read atomically, to be saved as a snapshot.
+	Checkpoint() (*SnapshotData, error)
+	// LastCommitted returns the commit sequence number and ID of the last
+	// committed transaction.
+	LastCommitted() (uint64, uuid.UUID)
+	// CommitSeq returns the commit sequence number of a transaction still
+	// in the committed history.
+	CommitSeq(txID uuid.UUID) (uint64, bool)
+	// Prune forgets the committed history up to watermark, the commit
+	// sequence number every node is known to have reached.
+	Prune(watermark uint64)
+	Watermark() uint64
+	ReadAt(seq uint64) (Version, error)
+	Versions() []Version
+	PruneVersions(keep int)
+	IsCommitted(txID uuid.UUID) bool
+	// LockHolders returns the transactions holding the lock.
+	LockHolders() []uuid.UUID
+	GetCommittedHistory() map[uuid.UUID]uint64
 }
 
 type volatileStore struct {
-	mu            sync.RWMutex
-	locked        bool
-	lockedByTx    uuid.UUID
-	state         int
-	proposedValue int
-	committedLog  map[uuid.UUID]bool
+	mu      sync.RWMutex
+	machine StateMachine
+	// locks maps every transaction holding the lock to its proposed command.
+	// Prepare only ever grants the lock to a single transaction; more than
+	// one holder is only possible after recovery re-acquires the locks of
+	// several in-doubt transactions.
+	locks map[uuid.UUID][]byte
+	// committedLog maps committed transactions to their commit sequence
+	// numbers.
+	committedLog map[uuid.UUID]uint64
+	// seq and lastTx identify the last committed transaction, and versions
+	// holds the retained states, oldest first, the last one being the
+	// current state.
+	seq      uint64
+	lastTx   uuid.UUID
+	versions []Version
+	// commits is the COMMITTED record of every transaction in commit order,
+	// and historyHash chains their IDs in that same order.
+	commits     []Entry
+	historyHash [sha256.Size]byte
+	// watermark is the commit sequence number every node reached. The
+	// history up to it is pruned, except for the last commit.
+	watermark uint64
+}
+
+// Recover resets the store to a snapshot, saved locally or received from a
+// peer. A nil snapshot is the empty initial state.
+func (vs *volatileStore) Recover(snapshot *SnapshotData) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if snapshot == nil {
+		snapshot = &SnapshotData{}
+	}
+
+	vs.committedLog = make(map[uuid.UUID]uint64, len(snapshot.CommittedLog))
+	vs.seq, vs.lastTx = snapshot.Seq, uuid.Nil
+	for txID, seq := range snapshot.CommittedLog {
+		vs.committedLog[txID] = seq
+		if seq == snapshot.Seq {
+			vs.lastTx = txID
+		}
+	}
+
+	if err := vs.machine.Restore(snapshot.State); err != nil {
+		return err
+	}
+
+	// Transactions the snapshot holds as committed no longer hold a lock.
+	for txID := range vs.locks {
+		if _, ok := vs.committedLog[txID]; ok {
+			delete(vs.locks, txID)
+		}
+	}
+
+	vs.commits = slices.Clone(snapshot.Commits)
+	vs.historyHash = snapshot.HistoryHash
+	vs.watermark = snapshot.Watermark
+	vs.versions = nil
+	return vs.addVersion()
+}
+
+// Replay applies a transaction committed elsewhere than through the lock:
+// found in the WAL during recovery, or fetched from a peer. Transactions
+// already committed are skipped, and a lock the transaction may still hold
+// is released. Records written before sequence numbers were persisted carry
+// none and get the next one.
+//
+// A sequence number at or below the current one is already part of the
+// state, even when its transaction was pruned from the history: the WAL
+// still holds it after a crash between a snapshot and the compaction, or
+// when the snapshot was installed from a peer.
+func (vs *volatileStore) Replay(record Entry) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if _, ok := vs.committedLog[record.TxID]; ok {
+		return nil
+	}
+	if record.Seq != 0 && record.Seq <= vs.seq {
+		delete(vs.locks, record.TxID)
+		return nil
+	}
+
+	if err := vs.machine.Apply(record.Command); err != nil {
+		return err
+	}
+	delete(vs.locks, record.TxID)
+
+	if record.Seq == 0 {
+		record.Seq = vs.seq + 1
+	}
+	return vs.markCommitted(record)
+}
+
+// markCommitted records a transaction as committed under its sequence
+// number and adds the resulting version.
+func (vs *volatileStore) markCommitted(record Entry) error {
+	record.State = TRANSACTION_COMMITTED
+	record.Command = slices.Clone(record.Command)
+	record.Participants = slices.Clone(record.Participants)
+
+	vs.committedLog[record.TxID] = record.Seq
+	vs.seq, vs.lastTx = record.Seq, record.TxID
+	vs.commits = append(vs.commits, record)
+	vs.historyHash = sha256.Sum256(append(vs.historyHash[:], record.TxID[:]...))
+	return vs.addVersion()
+}
+
+func (vs *volatileStore) Fingerprint() (Fingerprint, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	state, err := vs.machine.Snapshot()
+	if err != nil {
+		return Fingerprint{}, err
+	}
+
+	return Fingerprint{
+		Seq:         vs.seq,
+		LastTxID:    vs.lastTx,
+		StateHash:   sha256.Sum256(state),
+		HistoryHash: vs.historyHash,
+	}, nil
+}
+
+func (vs *volatileStore) Commits(after uint64) ([]Entry, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	if after < vs.seq && (len(vs.commits) == 0 || vs.commits[0].Seq > after+1) {
+		return nil, ErrCommitsPruned
+	}
+
+	i, _ := slices.BinarySearchFunc(vs.commits, after+1, func(e Entry, seq uint64) int {
+		return cmp.Compare(e.Seq, seq)
+	})
+	return slices.Clone(vs.commits[i:]), nil
+}
+
+func (vs *volatileStore) LastCommitted() (uint64, uuid.UUID) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return vs.seq, vs.lastTx
+}
+
+func (vs *volatileStore) CommitSeq(txID uuid.UUID) (uint64, bool) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	seq, ok := vs.committedLog[txID]
+	return seq, ok
+}
+
+func (vs *volatileStore) Watermark() uint64 {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return vs.watermark
 }
 
-func (vs *volatileStore) Recover(state int, committedLog map[uuid.UUID]bool) {
+// Prune drops the transactions committed at or below watermark from the
+// committed history. The last commit is kept, as it identifies the current
+// position. A watermark beyond that position is lowered to it.
+func (vs *volatileStore) Prune(watermark uint64) {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	vs.state = state
-	if committedLog != nil {
-		vs.committedLog = committedLog
-	} else {
-		vs.committedLog = make(map[uuid.UUID]bool)
+	watermark = min(watermark, vs.seq)
+	if watermark <= vs.watermark {
+		return
+	}
+	vs.watermark = watermark
+
+	for txID, seq := range vs.committedLog {
+		if seq <= watermark && seq != vs.seq {
+			delete(vs.committedLog, txID)
+		}
+	}
+
+	i, _ := slices.BinarySearchFunc(vs.commits, watermark+1, func(e Entry, seq uint64) int {
+		return cmp.Compare(e.Seq, seq)
+	})
+	vs.commits = slices.Clone(vs.commits[i:])
+}
+
+// addVersion records the current state as the version of the last commit.
+func (vs *volatileStore) addVersion() error {
+	state, err := vs.machine.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	vs.versions = append(vs.versions, Version{Seq: vs.seq, TxID: vs.lastTx, State: state})
+	return nil
+}
+
+// ReadAt returns the state as of commit seq, that is the version of the
+// last transaction committed at or before it.
+func (vs *volatileStore) ReadAt(seq uint64) (Version, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	if seq > vs.seq {
+		return Version{}, ErrVersionNotFound
+	}
+
+	for i := len(vs.versions) - 1; i >= 0; i-- {
+		if vs.versions[i].Seq <= seq {
+			return vs.versions[i], nil
+		}
+	}
+
+	return Version{}, ErrVersionPruned
+}
+
+func (vs *volatileStore) Versions() []Version {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	return slices.Clone(vs.versions)
+}
+
+// PruneVersions garbage collects all but the keep most recent versions. The
+// current state is always kept.
+func (vs *volatileStore) PruneVersions(keep int) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	keep = max(keep, 1)
+	if len(vs.versions) > keep {
+		vs.versions = slices.Clone(vs.versions[len(vs.versions)-keep:])
 	}
 }
 
-func (vs *volatileStore) GetCommittedHistory() map[uuid.UUID]bool {
+func (vs *volatileStore) Snapshot() ([]byte, error) {
 	vs.mu.RLock()
 	defer vs.mu.RUnlock()
+	return vs.machine.Snapshot()
+}
 
-	copyMap := make(map[uuid.UUID]bool, len(vs.committedLog))
+func (vs *volatileStore) Checkpoint() (*SnapshotData, error) {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	state, err := vs.machine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SnapshotData{
+		State:        state,
+		Seq:          vs.seq,
+		CommittedLog: maps.Clone(vs.committedLog),
+		Commits:      slices.Clone(vs.commits),
+		HistoryHash:  vs.historyHash,
+		Watermark:    vs.watermark,
+	}, nil
+}
+
+func (vs *volatileStore) GetCommittedHistory() map[uuid.UUID]uint64 {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	copyMap := make(map[uuid.UUID]uint64, len(vs.committedLog))
 	maps.Copy(copyMap, vs.committedLog)
 	return copyMap
 }
 
-func (vs *volatileStore) State() int {
+func (vs *volatileStore) LockHolders() []uuid.UUID {
 	vs.mu.RLock()
 	defer vs.mu.RUnlock()
-	return vs.state
+	return slices.Collect(maps.Keys(vs.locks))
 }
 
-func (vs *volatileStore) Prepare(txID uuid.UUID, newState int) error {
+func (vs *volatileStore) IsCommitted(txID uuid.UUID) bool {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+	_, ok := vs.committedLog[txID]
+	return ok
+}
+
+func (vs *volatileStore) Prepare(txID uuid.UUID, cmd []byte) error {
+	return vs.PrepareIf(txID, cmd, nil)
+}
+
+// PrepareIf prepares the transaction only if the state machine snapshot
+// equals expected. A nil expected skips the check.
+func (vs *volatileStore) PrepareIf(txID uuid.UUID, cmd, expected []byte) error {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	if vs.committedLog[txID] {
-		return errors.New("transaction already committed")
+	if _, ok := vs.committedLog[txID]; ok {
+		return ErrAlreadyCommitted
 	}
 
-	if vs.locked {
-		if vs.lockedByTx == txID {
+	if len(vs.locks) > 0 {
+		if _, ok := vs.locks[txID]; ok {
 			return nil
 		}
-		return errors.New("node is locked by another transaction")
+		return ErrLocked
 	}
 
-	vs.locked = true
-	vs.lockedByTx = txID
-	vs.proposedValue = newState
+	if expected != nil {
+		current, err := vs.machine.Snapshot()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(current, expected) {
+			return fmt.Errorf("%w: state changed since it was read", ErrPreconditionFailed)
+		}
+	}
+
+	if err := vs.machine.Validate(cmd); err != nil {
+		return err
+	}
+
+	vs.locks[txID] = cmd
 
 	return nil
 }
 
-func (vs *volatileStore) Commit(txID uuid.UUID) error {
+// Reacquire grants the lock to an in-doubt transaction found during recovery,
+// regardless of other holders. Its outcome was already promised to the
+// coordinator, so it must not be refused.
+func (vs *volatileStore) Reacquire(txID uuid.UUID, cmd []byte) {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	if vs.committedLog[txID] {
+	vs.locks[txID] = cmd
+}
+
+// Commit applies the transaction holding the lock and records it under the
+// commit sequence number of the record.
+func (vs *volatileStore) Commit(record Entry) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	txID := record.TxID
+
+	if _, ok := vs.committedLog[txID]; ok {
 		return nil
 	}
 
-	if !vs.locked || vs.lockedByTx != txID {
+	cmd, ok := vs.locks[txID]
+	if !ok {
 		return errors.New("invalid transaction commit")
 	}
 
-	vs.state = vs.proposedValue
-	vs.locked = false
-	vs.lockedByTx = uuid.Nil
-	vs.committedLog[txID] = true
+	if err := vs.machine.Apply(cmd); err != nil {
+		return err
+	}
+	delete(vs.locks, txID)
 
-	return nil
+	record.Command = cmd
+	return vs.markCommitted(record)
 }
 
 func (vs *volatileStore) Abort(txID uuid.UUID) error {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
-	if vs.committedLog[txID] {
+	if _, ok := vs.committedLog[txID]; ok {
 		return errors.New("cannot abort a committed transaction")
 	}
 
-	if !vs.locked || vs.lockedByTx != txID {
-		return nil
-	}
-
-	vs.locked = false
-	vs.lockedByTx = uuid.Nil
-	vs.proposedValue = vs.state
+	delete(vs.locks, txID)
 
 	return nil
 }
 
-func NewVolatileStore(state int) VolatileStore {
-	return &volatileStore{
-		state:        state,
-		committedLog: make(map[uuid.UUID]bool),
+func NewVolatileStore(machine StateMachine) VolatileStore {
+	vs := &volatileStore{
+		machine:      machine,
+		locks:        make(map[uuid.UUID][]byte),
+		committedLog: make(map[uuid.UUID]uint64),
 	}
+	vs.addVersion()
+	return vs
 }
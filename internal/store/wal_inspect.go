@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// WALRecord is a record of a file WAL, with the byte range it occupies.
+type WALRecord struct {
+	Offset int64
+	End    int64
+	Entry  Entry
+}
+
+// WALCorruption reports the first record of a file WAL that could not be
+// read. Everything before Offset is intact.
+type WALCorruption struct {
+	Offset int64
+	Err    error
+}
+
+func (c *WALCorruption) Error() string {
+	return fmt.Sprintf("WAL is corrupted at offset %d: %v", c.Offset, c.Err)
+}
+
+func (c *WALCorruption) Unwrap() error {
+	return c.Err
+}
+
+// ScanWAL reads the file WAL of a node in dataDir without opening the store,
+// so it works on the log of a node that is running or failed to recover.
+// Encrypted records are opened with the keys of opts. Reading stops at the
+// first record that cannot be read, reported as a *WALCorruption along with
+// the records before it. A record whose key is missing is not corrupted:
+// ErrEncrypted or ErrUnknownKey is returned instead.
+func ScanWAL(dataDir string, nodeID int, opts ...StoreOption) ([]WALRecord, error) {
+	f, err := os.Open(WALPath(dataDir, nodeID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// gob only reads whole messages from an io.ByteReader, so the count is
+	// the end of the last record decoded.
+	r := &countingReader{r: bufio.NewReader(f)}
+	decoder := gob.NewDecoder(r)
+	sealer := newSealer(opts)
+
+	var records []WALRecord
+	for {
+		offset := r.n
+
+		var e Entry
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF && r.n == offset {
+				return records, nil
+			}
+			return records, &WALCorruption{Offset: offset, Err: err}
+		}
+
+		e, err := sealer.openEntry(e)
+		if errors.Is(err, ErrEncrypted) || errors.Is(err, ErrUnknownKey) {
+			return records, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		if err != nil {
+			return records, &WALCorruption{Offset: offset, Err: err}
+		}
+		records = append(records, WALRecord{Offset: offset, End: r.n, Entry: e})
+	}
+}
+
+// TruncateWAL cuts the file WAL of a node in dataDir at offset, which must
+// be the end of a record, typically the offset of a *WALCorruption. The data
+// directory is locked meanwhile, so it fails if the node is running.
+func TruncateWAL(dataDir string, nodeID int, offset int64) error {
+	lock, err := lockDataDir(dataDir, nodeID)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	filename := WALPath(dataDir, nodeID)
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if offset < 0 || offset > info.Size() {
+		return fmt.Errorf("offset %d is outside the WAL (%d bytes)", offset, info.Size())
+	}
+
+	return os.Truncate(filename, offset)
+}
+
+// LoadSnapshotFile reads the snapshot of the file WAL of a node in dataDir,
+// nil if there is none.
+func LoadSnapshotFile(dataDir string, nodeID int, opts ...StoreOption) (*SnapshotData, error) {
+	f, err := os.Open(SnapshotPath(dataDir, nodeID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readSnapshotFile(bufio.NewReader(f), newSealer(opts))
+}
+
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
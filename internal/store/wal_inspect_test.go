@@ -0,0 +1,140 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestWALInspect_ScansAndTruncatesCorruptedTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStableStore(dir, 1)
+	if err != nil {
+		t.Fatalf("NewStableStore failed: %v", err)
+	}
+	defer func() { s.Close() }()
+	for i, delta := range []int{4, 5} {
+		txID := uuid.New()
+		if err := s.WritePrepared(txID, CounterAdd(delta), 1, []int{1}); err != nil {
+			t.Fatalf("WritePrepared failed: %v", err)
+		}
+		if err := s.WriteCommited(txID, CounterAdd(delta), uint64(i+1), 1, []int{1}); err != nil {
+			t.Fatalf("WriteCommited failed: %v", err)
+		}
+	}
+
+	// The WAL can be read while the store is open, but not cut.
+	records, err := ScanWAL(dir, 1)
+	if err != nil {
+		t.Fatalf("ScanWAL failed: %v", err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected 4 records, got %d", len(records))
+	}
+	for i, r := range records {
+		if i > 0 && r.Offset != records[i-1].End {
+			t.Errorf("Record %d starts at %d, previous ends at %d", i, r.Offset, records[i-1].End)
+		}
+	}
+	if records[3].Entry.State != TRANSACTION_COMMITTED || records[3].Entry.Seq != 2 {
+		t.Errorf("Unexpected last record: %+v", records[3].Entry)
+	}
+	if err := TruncateWAL(dir, 1, records[3].End); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("Expected ErrDataDirLocked, got %v", err)
+	}
+	s.Close()
+
+	// A torn write at the end of the log is reported at its offset, with
+	// the records before it.
+	walPath := WALPath(dir, 1)
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != records[3].End {
+		t.Errorf("Last record ends at %d, WAL holds %d bytes", records[3].End, info.Size())
+	}
+	f, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x40, 0xff, 0x13})
+	f.Close()
+
+	records, err = ScanWAL(dir, 1)
+	var corruption *WALCorruption
+	if !errors.As(err, &corruption) {
+		t.Fatalf("Expected a WALCorruption, got %v", err)
+	}
+	if corruption.Offset != info.Size() || len(records) != 4 {
+		t.Errorf("Expected corruption at %d after 4 records, got %d after %d", info.Size(), corruption.Offset, len(records))
+	}
+
+	if err := TruncateWAL(dir, 1, corruption.Offset); err != nil {
+		t.Fatalf("TruncateWAL failed: %v", err)
+	}
+	if records, err = ScanWAL(dir, 1); err != nil || len(records) != 4 {
+		t.Errorf("Expected 4 clean records after truncating, got %d, %v", len(records), err)
+	}
+
+	// The store reads the truncated log to its end again.
+	if s, err = NewStableStore(dir, 1); err != nil {
+		t.Fatalf("Failed to reopen the store: %v", err)
+	}
+	counter := NewCounter(0)
+	err = s.ReplayLog(func(e Entry) error {
+		if e.State == TRANSACTION_COMMITTED {
+			return counter.Apply(e.Command)
+		}
+		return nil
+	})
+	if err != nil || counter.Value() != 9 {
+		t.Errorf("Expected the truncated log to replay to 9, got %d, %v", counter.Value(), err)
+	}
+}
+
+func TestScanWAL_MissingKeyIsNotCorruption(t *testing.T) {
+	dir := t.TempDir()
+	keys, err := NewFileKeyProvider(filepath.Join(dir, "keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStableStore(dir, 1, WithEncryption(keys))
+	if err != nil {
+		t.Fatalf("NewStableStore failed: %v", err)
+	}
+	if err := s.WritePrepared(uuid.New(), CounterAdd(1), 1, []int{1}); err != nil {
+		t.Fatalf("WritePrepared failed: %v", err)
+	}
+	s.Close()
+
+	// Truncating at the offset of a record that only lacks its key would
+	// discard the whole log.
+	var corruption *WALCorruption
+	_, err = ScanWAL(dir, 1)
+	if !errors.Is(err, ErrEncrypted) || errors.As(err, &corruption) {
+		t.Errorf("Expected ErrEncrypted without a key, got %v", err)
+	}
+
+	otherPath := filepath.Join(dir, "other-keys")
+	if err := os.WriteFile(otherPath, []byte("spare "+strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewFileKeyProvider(otherPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ScanWAL(dir, 1, WithEncryption(other))
+	if !errors.Is(err, ErrUnknownKey) || errors.As(err, &corruption) {
+		t.Errorf("Expected ErrUnknownKey with the wrong keys, got %v", err)
+	}
+
+	records, err := ScanWAL(dir, 1, WithEncryption(keys))
+	if err != nil || len(records) != 1 {
+		t.Errorf("Expected 1 record with the right keys, got %d, %v", len(records), err)
+	}
+}
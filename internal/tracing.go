@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Finished spans are exported in batches of up to tracingBatchSize, at least
+// every tracingFlushInterval. Up to tracingQueueSize spans wait for export
+// before new ones are dropped.
+const (
+	tracingBatchSize     = 128
+	tracingFlushInterval = time.Second
+	tracingQueueSize     = 4096
+)
+
+// TraceContext identifies a span across nodes. It travels in RequestArgs, so
+// the prepare and commit spans of participants join the trace of the
+// coordinator's transaction, and follows W3C trace context: see Traceparent.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// Traceparent formats tc as a W3C traceparent header value.
+func (tc TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", tc.TraceID, tc.SpanID)
+}
+
+// SpanData is a finished span, as handed to a SpanExporter.
+type SpanData struct {
+	Name         string            `json:"name"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	NodeID       int               `json:"node_id"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	// Error is the error the span ended with, empty on success.
+	Error string `json:"error,omitempty"`
+}
+
+// SpanExporter sends finished spans to a tracing backend. Spans are handed
+// over in batches from a single goroutine.
+type SpanExporter interface {
+	ExportSpans(spans []SpanData) error
+}
+
+// tracer records the spans of a node and exports them in the background.
+// A nil tracer records nothing.
+type tracer struct {
+	nodeID   int
+	exporter SpanExporter
+	logger   *slog.Logger
+
+	// closedMu guards spans against the spans still ended by RPC handlers
+	// and background goroutines once the tracer is closed.
+	closedMu sync.RWMutex
+	closed   bool
+	spans    chan SpanData
+	flushed  chan struct{}
+
+	// traces maps the transactions the node is working on to the span
+	// their prepare, commit and abort spans are children of.
+	tracesMu sync.Mutex
+	traces   map[uuid.UUID]TraceContext
+}
+
+func newTracer(nodeID int, exporter SpanExporter, logger *slog.Logger) *tracer {
+	t := &tracer{
+		nodeID:   nodeID,
+		exporter: exporter,
+		logger:   logger,
+		spans:    make(chan SpanData, tracingQueueSize),
+		flushed:  make(chan struct{}),
+		traces:   make(map[uuid.UUID]TraceContext),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) run() {
+	defer close(t.flushed)
+
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	var batch []SpanData
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			t.logger.Warn("Failed to export spans", "count", len(batch), "error", err)
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= tracingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// close exports the spans still queued. Spans ended afterwards are dropped.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+
+	t.closedMu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.closedMu.Unlock()
+	<-t.flushed
+}
+
+// span is a span being recorded. A nil span records nothing.
+type span struct {
+	tracer *tracer
+	name   string
+	ctx    TraceContext
+	parent [8]byte
+	start  time.Time
+	attrs  map[string]string
+}
+
+// start begins a span, child of parent or the root of a new trace if parent
+// is not valid. Attributes are given as key and value pairs.
+func (t *tracer) start(name string, parent TraceContext, attrs ...any) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, name: name, start: time.Now(), attrs: make(map[string]string)}
+	if parent.IsValid() {
+		s.ctx.TraceID = parent.TraceID
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.ctx.TraceID[:])
+	}
+	rand.Read(s.ctx.SpanID[:])
+
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs[fmt.Sprint(attrs[i])] = fmt.Sprint(attrs[i+1])
+	}
+	return s
+}
+
+func (s *span) context() TraceContext {
+	if s == nil {
+		return TraceContext{}
+	}
+	return s.ctx
+}
+
+// end finishes the span, failed if err is not nil.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+
+	data := SpanData{
+		Name:       s.name,
+		TraceID:    hex.EncodeToString(s.ctx.TraceID[:]),
+		SpanID:     hex.EncodeToString(s.ctx.SpanID[:]),
+		NodeID:     s.tracer.nodeID,
+		Start:      s.start,
+		End:        time.Now(),
+		Attributes: s.attrs,
+	}
+	if s.parent != [8]byte{} {
+		data.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	s.tracer.closedMu.RLock()
+	defer s.tracer.closedMu.RUnlock()
+	if s.tracer.closed {
+		return
+	}
+
+	// Tracing must never slow the protocol down: spans are dropped while
+	// the exporter lags behind.
+	select {
+	case s.tracer.spans <- data:
+	default:
+	}
+}
+
+// traceTransaction makes tc the parent of the spans the node records for
+// txID, until the returned function is called.
+func (t *tracer) traceTransaction(txID uuid.UUID, tc TraceContext) func() {
+	if t == nil || !tc.IsValid() {
+		return func() {}
+	}
+
+	t.tracesMu.Lock()
+	t.traces[txID] = tc
+	t.tracesMu.Unlock()
+
+	return func() {
+		t.tracesMu.Lock()
+		defer t.tracesMu.Unlock()
+		if t.traces[txID] == tc {
+			delete(t.traces, txID)
+		}
+	}
+}
+
+// transactionTrace is the parent of the spans of txID, if it is traced.
+func (t *tracer) transactionTrace(txID uuid.UUID) TraceContext {
+	if t == nil {
+		return TraceContext{}
+	}
+	t.tracesMu.Lock()
+	defer t.tracesMu.Unlock()
+	return t.traces[txID]
+}
+
+type stdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter returns an exporter writing spans to w as JSON, one per
+// line. Despite its name, w can be any writer.
+func NewStdoutExporter(w io.Writer) SpanExporter {
+	return &stdoutExporter{w: w}
+}
+
+func (e *stdoutExporter) ExportSpans(spans []SpanData) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := encoder.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultOTLPEndpoint is where a local OpenTelemetry collector receives
+// traces over OTLP/HTTP.
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+type otlpExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewOTLPExporter returns an exporter posting spans to an OpenTelemetry
+// collector, in the JSON encoding of OTLP/HTTP. endpoint is the full URL of
+// the traces endpoint, DefaultOTLPEndpoint if empty.
+func NewOTLPExporter(endpoint string) SpanExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &otlpExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (e *otlpExporter) ExportSpans(spans []SpanData) error {
+	// Spans are grouped by node, each node being its own resource.
+	byNode := make(map[int][]otlpSpan)
+	var nodes []int
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		for k, v := range s.Attributes {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: map[string]string{"stringValue": v}})
+		}
+		if s.Error != "" {
+			span.Status.Code, span.Status.Message = 2, s.Error // STATUS_CODE_ERROR
+		}
+
+		if _, ok := byNode[s.NodeID]; !ok {
+			nodes = append(nodes, s.NodeID)
+		}
+		byNode[s.NodeID] = append(byNode[s.NodeID], span)
+	}
+
+	var resourceSpans []any
+	for _, id := range nodes {
+		resourceSpans = append(resourceSpans, map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{
+					{Key: "service.name", Value: map[string]string{"stringValue": "2pc"}},
+					{Key: "service.instance.id", Value: map[string]string{"stringValue": strconv.Itoa(id)}},
+				},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "github.com/rodrigocitadin/two-phase-commit"},
+				"spans": byNode[id],
+			}},
+		})
+	}
+
+	body, err := json.Marshal(map[string]any{"resourceSpans": resourceSpans})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *node) traceTransaction(txID uuid.UUID, tc TraceContext) func() {
+	return n.tracer.traceTransaction(txID, tc)
+}
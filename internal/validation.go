@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/rodrigocitadin/two-phase-commit/internal/store"
+)
+
+type RejectCode string
+
+const (
+	REJECT_LOCKED              RejectCode = "locked"
+	REJECT_ALREADY_COMMITTED   RejectCode = "already_committed"
+	REJECT_INVALID_COMMAND     RejectCode = "invalid_command"
+	REJECT_PRECONDITION_FAILED RejectCode = "precondition_failed"
+	REJECT_VALIDATION_FAILED   RejectCode = "validation_failed"
+	REJECT_STORAGE_FAILURE     RejectCode = "storage_failure"
+	REJECT_UNREACHABLE         RejectCode = "unreachable"
+)
+
+// RejectReason explains why a node voted no during prepare. It travels back
+// to the coordinator in the Prepare reply and is returned, wrapped, by
+// Transaction and Submit.
+type RejectReason struct {
+	NodeID  int
+	Code    RejectCode
+	Message string
+}
+
+// ErrPreconditionFailed is matched, through errors.Is, by the error of a
+// transaction rejected because the state it was conditioned on changed.
+var ErrPreconditionFailed = store.ErrPreconditionFailed
+
+func (r *RejectReason) Error() string {
+	return fmt.Sprintf("node %d rejected transaction (%s): %s", r.NodeID, r.Code, r.Message)
+}
+
+// Is lets errors.Is match precondition failures reported by remote nodes,
+// whose original error did not survive the RPC.
+func (r *RejectReason) Is(target error) bool {
+	return target == ErrPreconditionFailed && r.Code == REJECT_PRECONDITION_FAILED
+}
+
+// Validator is a participant-side hook run during prepare, once the
+// transaction holds the lock, so sm cannot change underneath it. Returning an
+// error makes the node vote no; a *RejectReason lets the validator choose
+// the reported code, any other error is reported as REJECT_VALIDATION_FAILED.
+type Validator func(txID uuid.UUID, cmd []byte, sm store.StateMachine) error
+
+// newRejectReason classifies an error raised while preparing a transaction.
+func newRejectReason(nodeID int, code RejectCode, err error) *RejectReason {
+	var reason *RejectReason
+	if errors.As(err, &reason) {
+		// Validators may return a shared reason, which must not be
+		// changed for every node and transaction using it.
+		r := *reason
+		r.NodeID = nodeID
+		if r.Code == "" {
+			r.Code = code
+		}
+		return &r
+	}
+
+	switch {
+	case errors.Is(err, store.ErrLocked):
+		code = REJECT_LOCKED
+	case errors.Is(err, store.ErrAlreadyCommitted):
+		code = REJECT_ALREADY_COMMITTED
+	case errors.Is(err, store.ErrPreconditionFailed):
+		code = REJECT_PRECONDITION_FAILED
+	}
+
+	return &RejectReason{NodeID: nodeID, Code: code, Message: err.Error()}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrStalePrepare rejects the prepare of a transaction started before the
+// watermark, whose outcome may already have been pruned from the history.
+var ErrStalePrepare = errors.New("stale prepare")
+
+// observeCommitAcks advances the watermark to the commit of txID once every
+// node of the cluster acknowledged it. The watermark is piggybacked on the
+// following requests, so the peers prune their history too.
+func (n *node) observeCommitAcks(txID uuid.UUID, results []Result[bool]) {
+	if len(results) != len(n.peers) {
+		return
+	}
+	for _, r := range results {
+		if r.Err != nil || !r.Value {
+			return
+		}
+	}
+
+	if seq, ok := n.volatileStore.CommitSeq(txID); ok {
+		n.advanceWatermark(seq)
+	}
+}
+
+func (n *node) advanceWatermark(watermark uint64) {
+	if watermark <= n.volatileStore.Watermark() {
+		return
+	}
+
+	n.volatileStore.Prune(watermark)
+	n.logger.Debug("Advanced watermark", "watermark", n.volatileStore.Watermark())
+}
+
+// checkStale rejects prepares based on a commit below the watermark. Every
+// node already reached the watermark when the prepare was sent, so such a
+// prepare is a duplicate of a transaction that already finished.
+func (n *node) checkStale(baseSeq uint64) error {
+	if watermark := n.volatileStore.Watermark(); baseSeq < watermark {
+		err := fmt.Errorf("%w: based on commit %d, below watermark %d", ErrStalePrepare, baseSeq, watermark)
+		return newRejectReason(n.id, REJECT_ALREADY_COMMITTED, err)
+	}
+	return nil
+}
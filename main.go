@@ -29,14 +29,14 @@ func main() {
 	}
 
 	nodes[0].Transaction(1)
-	fmt.Println("\n--- end of transaction ---\n")
+	fmt.Print("\n--- end of transaction ---\n\n")
 
 	nodes[1].Transaction(1)
-	fmt.Println("\n--- end of transaction ---\n")
+	fmt.Print("\n--- end of transaction ---\n\n")
 
 	nodes[3].Transaction(1)
-	fmt.Println("\n--- end of transaction ---\n")
+	fmt.Print("\n--- end of transaction ---\n\n")
 
 	nodes[2].Transaction(1)
-	fmt.Println("\n--- end of transaction ---\n")
+	fmt.Print("\n--- end of transaction ---\n\n")
 }